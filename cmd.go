@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"flag"
@@ -9,12 +10,14 @@ import (
 	"os/exec"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/google/subcommands"
 
 	"github.com/yuin/goldmark"
 	mdast "github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
 	"github.com/yuin/goldmark/text"
 
 	"github.com/charmbracelet/glamour"
@@ -32,23 +35,6 @@ func baseBlockLines(source []byte, v *mdast.BaseBlock) string {
 	return s
 }
 
-func parseInfo(info string) (string, map[string]string) {
-	split := strings.Split(info, " ")
-	language := split[0]
-
-	fields := map[string]string{}
-	for _, field := range split[1:] {
-		splitField := strings.SplitN(field, "=", 2)
-		var value string
-		if len(splitField) > 1 {
-			value = splitField[1]
-		}
-		fields[splitField[0]] = value
-	}
-
-	return language, fields
-}
-
 func UpWhere(initialDir, marker string) (string, error) {
 	dir := initialDir
 	for {
@@ -69,7 +55,21 @@ func UpWhere(initialDir, marker string) (string, error) {
 	}
 }
 
+// ParseCommandDefinitions parses the commands defined in source, including
+// those imported from other files. Imports are resolved relative to the
+// current directory.
 func ParseCommandDefinitions(source []byte) ([]CommandDefinition, error) {
+	return ParseCommandDefinitionsFile("", source)
+}
+
+// ParseCommandDefinitionsFile is like ParseCommandDefinitions, but records
+// inputPath as the file the commands were defined in and resolves imports
+// relative to it.
+func ParseCommandDefinitionsFile(inputPath string, source []byte) ([]CommandDefinition, error) {
+	return newImporter().parse(inputPath, source)
+}
+
+func (im *importer) parse(inputPath string, source []byte) ([]CommandDefinition, error) {
 	md := goldmark.New(
 		goldmark.WithExtensions(extension.GFM),
 	)
@@ -83,12 +83,40 @@ func ParseCommandDefinitions(source []byte) ([]CommandDefinition, error) {
 		name = ""
 	}
 	var definitions []CommandDefinition
+	// Variables apply to all commands defined in the same file, wherever
+	// in it they're given.
+	var own []int
+	variables := map[string]*VariableSource{}
 	err := mdast.Walk(node, func(n mdast.Node, entering bool) (mdast.WalkStatus, error) {
 		// fmt.Printf("n: %#v entering=%#v\n", n, entering)
 		if !entering {
 			return mdast.WalkContinue, nil
 		}
 		switch v := n.(type) {
+		case *mdast.HTMLBlock, *mdast.RawHTML, *mdast.Link:
+			imp, err := parseImport(n, source)
+			if err != nil {
+				return mdast.WalkStop, &PositionError{Pos: positionAt(inputPath, source, nodeStart(n)), Err: err}
+			}
+			if imp != nil {
+				imported, err := im.follow(inputPath, imp)
+				if err != nil {
+					return mdast.WalkStop, &PositionError{Pos: positionAt(inputPath, source, nodeStart(n)), Err: err}
+				}
+				definitions = append(definitions, imported...)
+			}
+		case *extast.Table:
+			vars, err := parseVariableTable(inputPath, source, v)
+			if err != nil {
+				return mdast.WalkStop, err
+			}
+			for name, v := range vars {
+				if prev, ok := variables[name]; ok {
+					return mdast.WalkStop, &PositionError{Pos: v.Pos, Err: fmt.Errorf("variable %s is already given at %s", name, prev.Pos)}
+				}
+				variables[name] = v
+			}
+			return mdast.WalkSkipChildren, nil
 		case *mdast.ThematicBreak:
 			reset()
 		case *mdast.Heading:
@@ -102,7 +130,8 @@ func ParseCommandDefinitions(source []byte) ([]CommandDefinition, error) {
 				}
 			}
 		case *mdast.FencedCodeBlock:
-			if heading != nil {
+			// Empty code blocks have nothing to run.
+			if heading != nil && v.Lines().Len() > 0 {
 				headingLines := heading.Lines()
 				headingStart := headingLines.At(0).Start
 				for headingStart >= 0 {
@@ -131,7 +160,32 @@ func ParseCommandDefinitions(source []byte) ([]CommandDefinition, error) {
 					}
 					declarationStop++
 				}
+				codeStart := v.Lines().At(0).Start
+				// Without an info string, the fence is on the line before
+				// the first line of code.
+				fenceStart := codeStart - 1
+				if v.Info != nil {
+					fenceStart = v.Info.Segment.Start
+				}
+				fenceStart = bytes.LastIndexByte(source[:fenceStart], '\n') + 1
+				for source[fenceStart] == ' ' {
+					fenceStart++
+				}
+				helpPos := helpStart
+				for helpPos < helpStop && isSpace(source[helpPos]) {
+					helpPos++
+				}
+				declarationPos := positionAt(inputPath, source, fenceStart)
+				own = append(own, len(definitions))
 				definitions = append(definitions, CommandDefinition{
+					InputPath:            inputPath,
+					DeclaretionLineStart: declarationPos.Line,
+
+					HeadingPos:     positionAt(inputPath, source, headingLines.At(0).Start),
+					HelpPos:        positionAt(inputPath, source, helpPos),
+					DeclarationPos: declarationPos,
+					CodePos:        positionAt(inputPath, source, codeStart),
+
 					Source:           source,
 					Name:             name,
 					HeadingStart:     headingStart,
@@ -151,9 +205,17 @@ func ParseCommandDefinitions(source []byte) ([]CommandDefinition, error) {
 		return nil, err
 	}
 
+	for _, i := range own {
+		definitions[i].Variables = variables
+	}
+
 	return definitions, nil
 }
 
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+}
+
 func ParseCommands(source []byte) ([]*Command, error) {
 	defs, err := ParseCommandDefinitions(source)
 
@@ -177,6 +239,20 @@ type CommandDefinition struct {
 	InputPath            string
 	DeclaretionLineStart int
 
+	// Positions of the heading, the help text, the code block's fence and
+	// its first line of code.
+	HeadingPos     Position
+	HelpPos        Position
+	DeclarationPos Position
+	CodePos        Position
+
+	// Group, when set, overrides the group given in the info string. It is
+	// set for commands imported into a group.
+	Group string
+
+	// Variables are the variable sources given in the same file.
+	Variables map[string]*VariableSource
+
 	Source           []byte
 	Name             string
 	HeadingStart     int
@@ -196,9 +272,9 @@ func (d *CommandDefinition) ParseDefinition() string {
 	return string(d.Source[d.HeadingStart:d.DeclarationStop])
 }
 
-func (d *CommandDefinition) ParseInfo() (string, map[string]string) {
+func (d *CommandDefinition) ParseInfo() (string, map[string]string, error) {
 	if d.Declaration.Info == nil {
-		return "", map[string]string{}
+		return "", map[string]string{}, nil
 	}
 
 	return parseInfo(string(d.Declaration.Info.Text(d.Source)))
@@ -208,17 +284,23 @@ func (d *CommandDefinition) ParseCommand() string {
 	return baseBlockLines(d.Source, &d.Declaration.BaseBlock)
 }
 
-func appendStrings(s []string, o []interface{}) []string {
-	for _, arg := range o {
-		s = append(s, fmt.Sprintf("%s", arg))
-	}
-	return s
-}
-
 const DefaultLanguage = "bash"
 
+// Parse parses the command defined by d. Errors are *PositionError, locating
+// the problem within the markdown file.
 func (d *CommandDefinition) Parse() (*Command, error) {
-	language, fields := d.ParseInfo()
+	cmd, err := d.parse()
+	if err != nil {
+		return nil, d.positionError(err)
+	}
+	return cmd, nil
+}
+
+func (d *CommandDefinition) parse() (*Command, error) {
+	language, fields, err := d.ParseInfo()
+	if err != nil {
+		return nil, err
+	}
 	// alias := fields["alias"]
 
 	if language == "" {
@@ -227,106 +309,102 @@ func (d *CommandDefinition) Parse() (*Command, error) {
 
 	text := d.ParseCommand()
 
-	var execCommand = language
-	var checkCommand = language
+	newLanguage, ok := LookupLanguage(language)
+	if !ok {
+		return nil, fmt.Errorf("unknown language for code block: %s", language)
+	}
 
-	setExecFlags := func(f *flag.FlagSet) {}
-	var renderCheckCmd func(ctx context.Context) *exec.Cmd
-	var renderExecCmd func(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error)
+	lang, err := newLanguage(language, text)
+	if err != nil {
+		return nil, err
+	}
 
-	switch language {
-	case "bash", "sh", "shell":
-		if language == "shell" {
-			execCommand = os.Getenv("SHELL")
-			checkCommand = execCommand
-		}
+	group := fields["group"]
+	if d.Group != "" {
+		group = d.Group
+	}
 
-		shellCommand, err := NewShellCommand(text)
+	var timeout time.Duration
+	if value := fields["timeout"]; value != "" {
+		timeout, err = time.ParseDuration(value)
 		if err != nil {
-			return nil, err
-		}
-
-		setExecFlags = func(f *flag.FlagSet) {
-			for l, defaultValue := range shellCommand.Locals {
-				var v string
-				if defaultValue == nil {
-					f.StringVar(&v, l, os.Getenv(l), fmt.Sprintf("falls back to $%s", l))
-				} else {
-					if defaultValue.Literal != "" {
-						f.StringVar(&v, l, defaultValue.Literal, fmt.Sprintf("falls back to $%s", l))
-					} else {
-						f.StringVar(&v, l, "", fmt.Sprintf("falls back to $%s (default is expression %s)", l, defaultValue.Expression))
-					}
-				}
-			}
+			return nil, fmt.Errorf("invalid timeout: %q", value)
 		}
+	}
 
-		// From the bash manual page:
-		// If the -c option is present, then commands are read from string.  If there are arguments after the string, they are assigned to the positional parameters, starting with $0.
-		renderExecCmd = func(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error) {
-			for env, defaultValue := range shellCommand.Exports {
-				if defaultValue == nil && os.Getenv(env) == "" {
-					return nil, fmt.Errorf("environment variable not set: %s", env)
-				}
-			}
+	retry, err := parseRetryPolicy(fields)
+	if err != nil {
+		return nil, err
+	}
 
-			locals := map[string]*ShellValue{}
+	params, err := parseParams(fields)
+	if err != nil {
+		return nil, err
+	}
 
-			for l, defaultValue := range shellCommand.Locals {
-				var v string
-				flag := f.Lookup(l)
-				set := false
+	renderCheckCmd := lang.RenderCheckCmd
+	setExecFlags := func(f *flag.FlagSet) {
+		for _, p := range params {
+			p.setFlag(f)
+		}
 
-				if flag != nil {
-					v = flag.Value.String()
-					set = v != ""
-				}
+		// Declared params take precedence over the flags the language
+		// infers from the code block.
+		langFlags := flag.NewFlagSet(f.Name(), flag.ContinueOnError)
+		lang.SetExecFlags(langFlags)
+		langFlags.VisitAll(func(fl *flag.Flag) {
+			if f.Lookup(fl.Name) == nil {
+				f.Var(fl.Value, fl.Name, fl.Usage)
+			}
+		})
+	}
+	renderExecCmd := func(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error) {
+		env, err := loadEnvironment(ctx, d.InputPath, d.Variables)
+		if err != nil {
+			return nil, err
+		}
+		ctx = withEnvironment(ctx, env)
+		f, err = env.flags(f, setExecFlags)
+		if err != nil {
+			return nil, err
+		}
 
-				if !set && defaultValue == nil {
-					return nil, fmt.Errorf("option not given: %s", l)
+		// Values of required params that weren't given are passed on
+		// through the environment rather than set as flags, as they may
+		// be secrets. Placeholders for dry runs needn't be valid.
+		missing := map[string]string{}
+		for _, p := range params {
+			if err := p.validate(f); err != nil {
+				value, err := missingValue(ctx, p.Name, err)
+				if err != nil {
+					return nil, err
 				}
-
-				if set {
-					locals[l] = &ShellValue{Literal: v}
+				if err := p.check(value); err != nil && !IsDryRun(ctx) {
+					return nil, fmt.Errorf("invalid value for %s: %w", p.Name, err)
 				}
+				missing[p.Name] = value
 			}
-
-			rendered, err := shellCommand.Render(locals)
-			if err != nil {
-				return nil, err
-			}
-			return exec.CommandContext(ctx,
-				execCommand,
-				append(
-					[]string{"-c", rendered, fmt.Sprint(args[0])},
-					f.Args()...,
-				)...,
-			), nil
-		}
-		renderCheckCmd = func(ctx context.Context) *exec.Cmd {
-			return exec.CommandContext(ctx, checkCommand, "-n", "-c", text)
-		}
-	case "python":
-		// From the python manual page:
-		//   -c command
-		//          Specify the command to execute (see next section).  This terminates the option list (following options are passed as arguments to the command).
-		renderExecCmd = func(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error) {
-			return exec.CommandContext(ctx, language, appendStrings([]string{"-c", text}, args)...), nil
 		}
-		renderCheckCmd = func(ctx context.Context) *exec.Cmd {
-			return exec.CommandContext(ctx, checkCommand, "-c", "import ast, sys; ast.parse(sys.argv[1])", text)
+
+		cmd, err := lang.RenderExecCmd(ctx, f, args...)
+		if err != nil {
+			return nil, err
 		}
-	case "node":
-		renderExecCmd = func(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error) {
-			return exec.CommandContext(ctx, language, appendStrings([]string{"--eval", text, "--"}, args)...), nil
+
+		for _, p := range params {
+			if value, ok := missing[p.Name]; ok {
+				setEnv(cmd, p.Name, value)
+			} else if flag := f.Lookup(p.Name); flag != nil {
+				setEnv(cmd, p.Name, flag.Value.String())
+			}
 		}
-		renderCheckCmd = func(ctx context.Context) *exec.Cmd {
-			return exec.CommandContext(ctx, checkCommand, "--eval", `const vm = require('vm'); new vm.Script(process.argv[1])`, "--", text)
+		env.apply(cmd)
+
+		cmd.Dir, err = workDir(ctx, d.InputPath, fields["dir"])
+		if err != nil {
+			return nil, err
 		}
-	default:
-		// TODO Or maybe as a fallback we write the command to a tempfile just before we need it?
-		// execArgs = []string{"-c", d.ParseCommand()}
-		return nil, fmt.Errorf("unknown language for code block: %s", language)
+		return cmd, nil
 	}
 
 	dockerImage := fields["image"]
@@ -342,26 +420,50 @@ func (d *CommandDefinition) Parse() (*Command, error) {
 			if err != nil {
 				return nil, err
 			}
-			cmd.Args = append([]string{"run", dockerImage, cmd.Path}, cmd.Args...)
-			cmd.Path = dockerPath
+			var extraArgs []string
+			if containerLang, ok := lang.(ContainerLanguage); ok {
+				extraArgs, err = containerLang.DockerArgs()
+				if err != nil {
+					return nil, err
+				}
+			}
+			wrapDocker(cmd, dockerPath, dockerImage, extraArgs...)
 			return cmd, nil
 		}
 
 		innerRenderCheckCmd := renderCheckCmd
-		renderCheckCmd = func(ctx context.Context) *exec.Cmd {
-			cmd := innerRenderCheckCmd(ctx)
-			cmd.Args = append([]string{"run", dockerImage, cmd.Path}, cmd.Args...)
-			cmd.Path = dockerPath
-			return cmd
+		renderCheckCmd = func(ctx context.Context) (*exec.Cmd, error) {
+			cmd, err := innerRenderCheckCmd(ctx)
+			if cmd == nil || err != nil {
+				return nil, err
+			}
+			wrapDocker(cmd, dockerPath, dockerImage)
+			return cmd, nil
 		}
 	}
 
 	return &Command{
+		InputPath: d.InputPath,
+		Variables: d.Variables,
+		Pos:       d.DeclarationPos,
+		CodePos:   d.CodePos,
+
 		Help:       d.ParseHelp(),
 		Definition: d.ParseDefinition(),
 
-		Alias: d.Name,
-		Group: fields["group"],
+		Alias:  d.Name,
+		Group:  group,
+		Params: params,
+		Needs:  splitList(fields["needs"]),
+
+		Confirm: confirmation(group, fields),
+		Log:     logField(fields),
+		Timeout: timeout,
+		Retry:   retry,
+		Dir:     fields["dir"],
+
+		Sources: splitList(fields["sources"]),
+		Outputs: splitList(fields["outputs"]),
 
 		RenderCheckCmd: renderCheckCmd,
 
@@ -370,14 +472,77 @@ func (d *CommandDefinition) Parse() (*Command, error) {
 	}, nil
 }
 
+// wrapDocker rewrites cmd to run within a new container for the given image.
+// The container is removed once done, and killed along with cmd by
+// killProcess, which finds it by name.
+func wrapDocker(cmd *exec.Cmd, dockerPath, image string, extraArgs ...string) {
+	name := containerName()
+	// Commands get stdin, if only /dev/null. With --init, the command
+	// doesn't run as PID 1, which ignores signals it has no handler for.
+	args := []string{"docker", "run", "-i", "--rm", "--init", "--name", name}
+	// The command's directory is mounted at the same path, and it runs there.
+	if cmd.Dir != "" {
+		args = append(args, "-v", cmd.Dir+":"+cmd.Dir, "-w", cmd.Dir)
+	}
+	// Variables set for the command are taken from docker's own environment.
+	for _, name := range changedEnv(cmd) {
+		args = append(args, "-e", name)
+	}
+	args = append(args, extraArgs...)
+	args = append(args, image)
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = dockerPath
+}
+
 type Command struct {
-	Alias string
-	Group string
+	Alias  string
+	Group  string
+	Params []*Param
+
+	// Needs lists the aliases of the commands to run before this one, and
+	// Dependencies the commands themselves, once resolved by LinkCommands.
+	Needs        []string
+	Dependencies []*Command
+
+	// Confirm, when set, is the warning shown before running the command,
+	// which only runs once confirmed.
+	Confirm string
+
+	// Log, when set, is the directory the command's output is logged to, or
+	// "true" for the default one. See logDir. Logged output is no longer a
+	// terminal, so commands may stop using colors or progress bars.
+	Log string
+
+	// Timeout, when set, limits how long the command may run.
+	Timeout time.Duration
+
+	// Retry tells whether to run the command again when it fails.
+	Retry RetryPolicy
+
+	// Dir, when set, is the directory the command runs in, relative to the
+	// file it is defined in, or to the project root if it starts with @root.
+	// Sources and Outputs stay relative to the file either way.
+	Dir string
+
+	// Sources and Outputs are globs for the files the command reads and
+	// writes, which tell whether it is up to date. See upToDate.
+	Sources []string
+	Outputs []string
+
+	// Variables are the variable sources given in the same file, whose
+	// values are secret.
+	Variables map[string]*VariableSource
+
+	// InputPath and Pos tell where the command is defined, and CodePos where
+	// its first line of code is.
+	InputPath string
+	Pos       Position
+	CodePos   Position
 
 	Help       string
 	Definition string
 
-	RenderCheckCmd func(ctx context.Context) *exec.Cmd
+	RenderCheckCmd func(ctx context.Context) (*exec.Cmd, error)
 
 	SetExecFlags  func(f *flag.FlagSet)
 	RenderExecCmd func(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error)
@@ -391,9 +556,20 @@ func (c *Command) Synopsis() string {
 }
 func (c *Command) Usage() string {
 	// return fmt.Sprintf("%s\n%s\n", c.Alias, c.Help)
-	out, err := glamour.Render(c.Definition, "dark")
+	definition := c.Definition
+	if c.Confirm != "" {
+		definition += "\n\n**Needs confirmation:** " + c.Confirm
+	}
+	if len(c.Params) > 0 {
+		definition += "\n\n**Parameters**\n\n"
+		for _, p := range c.Params {
+			definition += p.markdown() + "\n"
+		}
+	}
+
+	out, err := glamour.Render(definition, "dark")
 	if err != nil {
-		return c.Definition
+		return definition
 	}
 	return out
 }
@@ -401,40 +577,103 @@ func (c *Command) SetFlags(f *flag.FlagSet) {
 	c.SetExecFlags(f)
 }
 func (c *Command) Check(ctx context.Context) (string, error) {
-	cmd := c.RenderCheckCmd(ctx)
+	cmd, err := c.RenderCheckCmd(ctx)
+	if err != nil {
+		return "", err
+	}
+	if cmd == nil {
+		// Not every language has a way to check for syntax errors.
+		return "", nil
+	}
 	// fmt.Fprintf(os.Stderr, ">>> executing command path=%s args=%#v\n", cmd.Path, cmd.Args)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if pos, ok := c.checkPosition(string(out)); ok {
+			err = &PositionError{Pos: pos, Err: err}
+		}
 		return string(out), err
 	}
 
 	return string(out), nil
 }
 
+// Execute runs the commands c needs, then c itself. Those of them that need
+// confirmation are all confirmed before any runs.
 func (c *Command) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
-	cmd, err := c.RenderExecCmd(ctx, f, args...)
+	if !optionsFrom(ctx).DryRun {
+		var err error
+		ctx, err = confirmPlan(ctx, append(c.Plan(), c))
+		if err != nil {
+			fmt.Fprintf(optionsFrom(ctx).stdio().err, "fatal: %s\n", err)
+			return ExitNotConfirmed
+		}
+	}
+
+	if status := c.executeDependencies(ctx); status != subcommands.ExitSuccess {
+		return status
+	}
+
+	return c.execute(ctx, f, optionsFrom(ctx).stdio(), args...)
+}
+
+func (c *Command) execute(ctx context.Context, f *flag.FlagSet, stdio stdio, args ...interface{}) subcommands.ExitStatus {
+	opts := optionsFrom(ctx)
+
+	// Rendering may resolve secrets, prompt or build, so it only happens once
+	// confirmed. Dry runs have no such side effects and only note the
+	// warning.
+	if !opts.DryRun {
+		if err := c.confirm(ctx); err != nil {
+			fmt.Fprintf(stdio.err, "fatal: %s\n", err)
+			return ExitNotConfirmed
+		}
+	}
+
+	cmd, err := c.RenderExecCmd(detachedContext{ctx}, f, args...)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		fmt.Fprintf(stdio.err, "fatal: %s\n", err)
 		return subcommands.ExitUsageError
 	}
 	// fmt.Fprintf(os.Stderr, ">>> executing command path=%s args=%#v\n", cmd.Path, cmd.Args)
 
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
-	if err := cmd.Start(); err != nil {
-		fmt.Fprintf(os.Stderr, "err: %s", err)
-		return subcommands.ExitFailure
+	upToDate := false
+	if c.tracksFiles() && !opts.Force {
+		upToDate, err = c.upToDate(cmd)
+		if err != nil {
+			fmt.Fprintf(stdio.err, "fatal: %s\n", err)
+			return subcommands.ExitFailure
+		}
 	}
 
-	if err := cmd.Wait(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return subcommands.ExitStatus(exitErr.ExitCode())
-		}
+	if opts.DryRun {
+		fmt.Fprint(stdio.out, c.describe(cmd, upToDate))
+		return subcommands.ExitSuccess
+	}
+	if upToDate {
+		fmt.Fprintf(stdio.err, "%s is up to date\n", c.Alias)
+		return subcommands.ExitSuccess
+	}
 
-		fmt.Fprintf(os.Stderr, "err: %s", err)
+	start := time.Now()
+	logged, closeLog, err := c.teeLog(ctx, stdio, start)
+	if err != nil {
+		fmt.Fprintf(stdio.err, "fatal: %s\n", err)
 		return subcommands.ExitFailure
 	}
+	cmd, status := c.runRetrying(ctx, cmd, logged)
+	if err := closeLog(); err != nil {
+		fmt.Fprintf(stdio.err, "warning: %s\n", err)
+	}
+	if err := c.record(ctx, f, cmd, start, status); err != nil {
+		fmt.Fprintf(stdio.err, "warning: recording history: %s\n", err)
+	}
+	if status != subcommands.ExitSuccess {
+		return status
+	}
+
+	if err := c.saveFingerprint(cmd); err != nil {
+		fmt.Fprintf(stdio.err, "warning: %s\n", err)
+	}
 
 	return subcommands.ExitSuccess
 }
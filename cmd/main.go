@@ -5,85 +5,81 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"path"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/commandsmd/cmd"
 
-	getter "github.com/hashicorp/go-getter"
-
 	"github.com/google/subcommands"
 )
 
-func UpWhere(initialDir, marker string) (string, error) {
-	dir := initialDir
-	for {
-		_, err := os.Stat(path.Join(dir, marker))
-		if err == nil {
-			return dir, nil
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// loadCommands parses the commands defined at inputPath. Given a directory,
+// the commands of all the markdown files found by cmd.DiscoverInputs are
+// merged. Without an input path, commands are read from stdin, unless it is
+// a terminal, in which case they are discovered in the current directory.
+//
+// It also returns the directory of the project the commands belong to, where
+// state such as the history is kept.
+func loadCommands(inputPath string) ([]*cmd.Command, string, error) {
+	if inputPath == "" {
+		inputPath = "-"
+		if isTerminal(os.Stdin) {
+			inputPath = "."
 		}
+	}
 
-		if err != nil && !errors.Is(err, os.ErrNotExist) {
-			return dir, err
+	if info, err := os.Stat(inputPath); err == nil && info.IsDir() {
+		inputs, err := cmd.DiscoverInputs(inputPath)
+		if err != nil {
+			return nil, "", err
 		}
 
-		parent := path.Dir(dir)
-		if parent == dir {
-			return "", fmt.Errorf("couldn't find %s in any directory between %s and %s", marker, dir, initialDir)
+		sets := [][]*cmd.Command{}
+		for _, input := range inputs {
+			source, err := os.ReadFile(input)
+			if err != nil {
+				return nil, "", err
+			}
+
+			cmds, err := cmd.ParseCommandsFile(input, source)
+			if err != nil {
+				return nil, "", err
+			}
+			sets = append(sets, cmds)
 		}
-		dir = parent
-	}
-}
 
-func readFromURL(url string) ([]byte, error) {
-	f, err := ioutil.TempFile("", "*.md")
-	if err != nil {
-		return nil, err
+		cmds, err := cmd.MergeCommands(sets...)
+		return cmds, inputPath, err
 	}
 
-	defer os.Remove(f.Name())
-	defer f.Close()
-	err = getter.GetFile(f.Name(), url)
+	inputPath, source, err := cmd.ReadInput(inputPath)
 	if err != nil {
-		return nil, err
-	}
-
-	return io.ReadAll(f)
-}
-
-func readInput(inputPath string) ([]byte, error) {
-	if inputPath == "-" {
-		return io.ReadAll(os.Stdin)
+		return nil, "", err
 	}
 
-	if strings.HasPrefix(inputPath, ".../") {
-		marker := strings.TrimPrefix(inputPath, ".../")
-		cwd, err := os.Getwd()
-		if err != nil {
-			return nil, err
-		}
-
-		dir, err := UpWhere(cwd, marker)
-		if err != nil {
-			return nil, err
-		}
-		inputPath = path.Join(dir, marker)
+	cmds, err := cmd.ParseCommandsFile(inputPath, source)
+	if err != nil {
+		return nil, "", err
 	}
 
-	f, err := os.Open(inputPath)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return readFromURL(inputPath)
-		}
-		return nil, err
+	dir := "."
+	if _, err := os.Stat(inputPath); err == nil {
+		dir = filepath.Dir(inputPath)
 	}
-	defer f.Close()
 
-	return io.ReadAll(f)
+	// Even a single file mustn't define the same command twice.
+	cmds, err = cmd.MergeCommands(cmds)
+	return cmds, dir, err
 }
 
 type checkCommand struct {
@@ -110,17 +106,28 @@ func (c *checkCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...int
 		only[args[1].(string)] = true
 	}
 
-	for _, cmd := range c.commands {
-		if only != nil && !only[cmd.Alias] {
+	for _, command := range c.commands {
+		if only != nil && !only[command.Alias] {
 			continue
 		}
 
-		out, err := cmd.Check(ctx)
+		out, err := command.Check(ctx)
 		if err != nil {
-			fmt.Printf("error	%s: %s\n", cmd.Alias, err)
+			// Errors are reported as file:line:col so editors can jump
+			// to them, at the line the checker reports if it does.
+			pos := command.Location()
+			var posErr *cmd.PositionError
+			if errors.As(err, &posErr) {
+				pos, err = posErr.Pos.String(), posErr.Err
+			}
+			fmt.Printf("%s: %s: %s\n", pos, command.Alias, err)
 			failed = true
 		} else {
-			fmt.Printf("ok		%s\n", cmd.Alias)
+			fmt.Printf("ok		%s\n", command.Alias)
+		}
+		out = strings.TrimRight(out, "\n")
+		if out == "" {
+			continue
 		}
 		for _, line := range strings.Split(out, "\n") {
 			fmt.Printf("  %s\n", line)
@@ -134,6 +141,186 @@ func (c *checkCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...int
 	return subcommands.ExitSuccess
 }
 
+type runCommand struct {
+	name     string
+	commands []*cmd.Command
+}
+
+func (c *runCommand) Name() string     { return c.name }
+func (c *runCommand) Synopsis() string { return "run several commands" }
+func (c *runCommand) Usage() string {
+	return `run command...
+Runs the given commands and the commands they need, with the defaults for all
+their flags, one at a time. Given -j, commands that don't need one another run
+concurrently, up to that many at once.
+`
+}
+func (c *runCommand) SetFlags(f *flag.FlagSet) {}
+
+func (c *runCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	targets, err := lookupCommands(c.commands, f.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		return subcommands.ExitUsageError
+	}
+
+	return cmd.RunCommands(ctx, targets...)
+}
+
+type watchCommand struct {
+	name     string
+	commands []*cmd.Command
+
+	opts cmd.WatchOptions
+}
+
+func (c *watchCommand) Name() string     { return c.name }
+func (c *watchCommand) Synopsis() string { return "run a command whenever its sources change" }
+func (c *watchCommand) Usage() string {
+	return `watch [-clear] [-debounce duration] command [flags] [args]
+Runs the given command, with the given flags and arguments, then runs it again
+whenever the files matching its sources, or the sources of the commands it
+needs, change. A run still going by then is cancelled.
+`
+}
+func (c *watchCommand) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.opts.Clear, "clear", false, "clear the screen before each run")
+	f.DurationVar(&c.opts.Debounce, "debounce", cmd.DefaultWatchDebounce, "wait for changes to settle for `duration` before running")
+	f.DurationVar(&c.opts.Interval, "interval", cmd.DefaultWatchInterval, "check for changes every `duration`")
+}
+
+func (c *watchCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	targets, err := lookupCommands(c.commands, f.Args()[:1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		return subcommands.ExitUsageError
+	}
+	target := targets[0]
+
+	targetFlags := flag.NewFlagSet(target.Alias, flag.ContinueOnError)
+	target.SetFlags(targetFlags)
+	if err := targetFlags.Parse(f.Args()[1:]); err != nil {
+		return subcommands.ExitUsageError
+	}
+
+	if err := target.Watch(ctx, targetFlags, &c.opts, target.Alias); err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
+
+// lookupCommands returns the commands with the given aliases.
+func lookupCommands(cmds []*cmd.Command, aliases []string) ([]*cmd.Command, error) {
+	byAlias := map[string]*cmd.Command{}
+	for _, c := range cmds {
+		if c.Alias != "" {
+			byAlias[c.Alias] = c
+		}
+	}
+
+	var found []*cmd.Command
+	for _, alias := range aliases {
+		c, ok := byAlias[alias]
+		if !ok {
+			return nil, fmt.Errorf("unknown command %q", alias)
+		}
+		found = append(found, c)
+	}
+	return found, nil
+}
+
+type historyCommand struct {
+	name     string
+	commands []*cmd.Command
+	path     string
+
+	limit int
+	rerun int
+}
+
+func (c *historyCommand) Name() string     { return c.name }
+func (c *historyCommand) Synopsis() string { return "list or re-run past runs of commands" }
+func (c *historyCommand) Usage() string {
+	return `history [-n count] [-run number]
+Lists the most recent runs of commands, numbered, or runs the given one again
+with the same flags and arguments. Flags that look like secrets aren't
+recorded, so they have to be given again.
+`
+}
+func (c *historyCommand) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&c.limit, "n", 20, "list the last `count` runs, or all if 0")
+	f.IntVar(&c.rerun, "run", 0, "run the run with the given `number` again")
+}
+
+func (c *historyCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	entries, err := cmd.ReadHistory(c.path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	if c.rerun == 0 {
+		first := 0
+		if c.limit > 0 && len(entries) > c.limit {
+			first = len(entries) - c.limit
+		}
+		for i, e := range entries[first:] {
+			fmt.Printf("%4d  %s  %8s  exit %-3d  %-10s  %s\n",
+				first+i+1,
+				e.Start.Local().Format("2006-01-02 15:04:05"),
+				e.End.Sub(e.Start).Round(time.Millisecond),
+				e.ExitCode,
+				e.User,
+				strings.Join(e.CommandLine(), " "))
+		}
+		return subcommands.ExitSuccess
+	}
+
+	if c.rerun < 1 || c.rerun > len(entries) {
+		fmt.Fprintf(os.Stderr, "fatal: no run numbered %d\n", c.rerun)
+		return subcommands.ExitUsageError
+	}
+	e := entries[c.rerun-1]
+
+	targets, err := lookupCommands(c.commands, []string{e.Alias})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		return subcommands.ExitUsageError
+	}
+	target := targets[0]
+
+	line := e.CommandLine()
+	targetFlags := flag.NewFlagSet(target.Alias, flag.ContinueOnError)
+	target.SetFlags(targetFlags)
+	if err := targetFlags.Parse(line[1:]); err != nil {
+		return subcommands.ExitUsageError
+	}
+
+	fmt.Fprintf(os.Stderr, "running %s\n", strings.Join(line, " "))
+	return target.Execute(ctx, targetFlags, target.Alias)
+}
+
+// stringList is a flag.Value collecting each value given.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
 func main() {
 	// If both are set, we seem to be running within a bazel-run environment.
 	if os.Getenv("BUILD_WORKSPACE_DIRECTORY") != "" && os.Getenv("BUILD_WORKING_DIRECTORY") != "" {
@@ -153,30 +340,36 @@ func main() {
 		inputPath = arg
 		break
 	}
-	if inputPath == "" {
-		inputPath = "-"
-	}
-
-	source, err := readInput(inputPath)
-	if err != nil {
-		panic(err)
-	}
 
-	args := []interface{}{}
-	for _, arg := range os.Args[restIndex:] {
-		args = append(args, arg)
+	cmds, projectDir, err := loadCommands(inputPath)
+	if err == nil {
+		err = cmd.LinkCommands(cmds)
 	}
-
-	cmds, err := cmd.ParseCommands(source)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		os.Exit(int(subcommands.ExitUsageError))
 	}
 
+	historyFile := filepath.Join(projectDir, ".cmd", "history.jsonl")
+
 	subcommands.Register(subcommands.HelpCommand(), "")
 	subcommands.Register(&checkCommand{
 		name:     "check",
 		commands: cmds,
 	}, "")
+	subcommands.Register(&runCommand{
+		name:     "run",
+		commands: cmds,
+	}, "")
+	subcommands.Register(&historyCommand{
+		name:     "history",
+		commands: cmds,
+		path:     historyFile,
+	}, "")
+	subcommands.Register(&watchCommand{
+		name:     "watch",
+		commands: cmds,
+	}, "")
 
 	// subcommands.Register(subcommands.FlagsCommand(), "")
 	// subcommands.Register(subcommands.CommandsCommand(), "")
@@ -193,9 +386,52 @@ func main() {
 	}
 	parseArgs := append([]string{}, os.Args[restIndex:]...)
 
+	opts := &cmd.Options{
+		Root:        projectDir,
+		HistoryFile: historyFile,
+	}
+	flag.IntVar(&opts.Jobs, "j", 0, "run up to `N` commands at once (default one at a time)")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "print what would run instead of running it")
+	flag.BoolVar(&opts.DryRun, "n", false, "shorthand for -dry-run")
+	flag.BoolVar(&opts.Force, "force", false, "run commands even if they are up to date")
+	flag.Var((*stringList)(&opts.EnvFiles), "env-file", "read variables from `file`, besides .env (repeatable)")
+	flag.StringVar(&opts.Profile, "profile", "", "read variables from .env.`profile` too")
+	flag.StringVar(&opts.LogDir, "log-dir", "", "also log the output of commands to files in `dir` (commands then don't write to a terminal)")
+	flag.DurationVar(&opts.Timeout, "timeout", 0, "stop commands running longer than `duration`")
+	flag.DurationVar(&opts.GracePeriod, "grace-period", 10*time.Second, "give interrupted commands `duration` to exit before killing them")
+	flag.BoolVar(&opts.Yes, "yes", false, "run commands needing confirmation without asking")
+	noInput := flag.Bool("no-input", false, "fail instead of prompting for missing values")
+
 	if err = flag.CommandLine.Parse(parseArgs); err != nil {
 		log.Fatal(err)
 	}
-	ctx := context.Background()
+	if !*noInput && isTerminal(os.Stdin) {
+		opts.Prompt = promptMissing
+		opts.Confirm = confirmRun
+	}
+	// Interrupting stops what's running, and keeps anything else from
+	// starting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx = cmd.WithOptions(ctx, opts)
+
+	// Without a command, let the user pick one if there's anyone to ask.
+	if flag.CommandLine.NArg() == 0 && isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		c, f, err := pickAndPrompt(cmds)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+			os.Exit(int(subcommands.ExitFailure))
+		}
+		if c == nil {
+			os.Exit(int(subcommands.ExitSuccess))
+		}
+		os.Exit(int(c.Execute(ctx, f, c.Alias)))
+	}
+	// Commands get the arguments after the global flags, starting with
+	// their alias.
+	args := []interface{}{}
+	for _, arg := range flag.CommandLine.Args() {
+		args = append(args, arg)
+	}
 	os.Exit(int(subcommands.Execute(ctx, args...)))
 }
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/commandsmd/cmd"
+
+	"golang.org/x/term"
+)
+
+// Keys read from the terminal, besides printable characters.
+const (
+	keyNone = iota
+	keyUp
+	keyDown
+	keyEnter
+	keyBackspace
+	keyClear
+	keyCancel
+)
+
+// A terminal reads keys from in, which it puts in raw mode, and draws to out.
+type terminal struct {
+	in    *os.File
+	out   io.Writer
+	keys  *bufio.Reader
+	state *term.State
+}
+
+func newTerminal(in, out *os.File) (*terminal, error) {
+	state, err := term.MakeRaw(int(in.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	return &terminal{in: in, out: out, keys: bufio.NewReader(in), state: state}, nil
+}
+
+func (t *terminal) restore() error {
+	return term.Restore(int(t.in.Fd()), t.state)
+}
+
+// size returns the width and height of the terminal, falling back to 80x24.
+func (t *terminal) size() (int, int) {
+	if f, ok := t.out.(*os.File); ok {
+		if w, h, err := term.GetSize(int(f.Fd())); err == nil && w > 0 && h > 0 {
+			return w, h
+		}
+	}
+	return 80, 24
+}
+
+// readKey returns the next key pressed, or the character typed.
+func (t *terminal) readKey() (int, rune, error) {
+	r, _, err := t.keys.ReadRune()
+	if err != nil {
+		return keyNone, 0, err
+	}
+
+	switch r {
+	case '\r', '\n':
+		return keyEnter, 0, nil
+	case 127, '\b':
+		return keyBackspace, 0, nil
+	case 'U' & 0x1f:
+		return keyClear, 0, nil
+	case 'P' & 0x1f:
+		return keyUp, 0, nil
+	case 'N' & 0x1f:
+		return keyDown, 0, nil
+	case 'C' & 0x1f, 'D' & 0x1f:
+		return keyCancel, 0, nil
+	case '\x1b':
+		// A lone escape cancels, while escape sequences are sent all at
+		// once and so are already buffered.
+		if t.keys.Buffered() == 0 {
+			return keyCancel, 0, nil
+		}
+		seq := make([]byte, t.keys.Buffered())
+		n, _ := t.keys.Read(seq)
+		switch string(seq[:n]) {
+		case "[A", "OA":
+			return keyUp, 0, nil
+		case "[B", "OB":
+			return keyDown, 0, nil
+		}
+		return keyNone, 0, nil
+	}
+
+	if !unicode.IsPrint(r) {
+		return keyNone, 0, nil
+	}
+	return keyNone, r, nil
+}
+
+// printLines prints s, as raw mode needs explicit carriage returns.
+func (t *terminal) printLines(s string) {
+	fmt.Fprint(t.out, strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "\r\n"))
+}
+
+// fuzzyScore reports whether the characters of query appear in order within
+// s, ignoring case, and how well: the lower the score, the closer together
+// and the earlier in s they are.
+func fuzzyScore(query, s string) (int, bool) {
+	query, s = strings.ToLower(query), strings.ToLower(s)
+	score, last := 0, -1
+	for _, q := range query {
+		i := strings.IndexRune(s[last+1:], q)
+		if i < 0 {
+			return 0, false
+		}
+		score += i
+		last += i + len(string(q))
+	}
+	return score, true
+}
+
+// filterCommands returns the commands matching query, best matches first.
+// Matches within the alias rank above matches within the group or synopsis.
+func filterCommands(cmds []*cmd.Command, query string) []*cmd.Command {
+	type match struct {
+		c     *cmd.Command
+		score int
+	}
+	var matches []match
+	for _, c := range cmds {
+		if score, ok := fuzzyScore(query, c.Alias); ok {
+			matches = append(matches, match{c, score})
+		} else if score, ok := fuzzyScore(query, c.Alias+" "+c.Group+" "+c.Synopsis()); ok {
+			matches = append(matches, match{c, 1000 + score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score < matches[j].score })
+
+	filtered := make([]*cmd.Command, len(matches))
+	for i, m := range matches {
+		filtered[i] = m.c
+	}
+	return filtered
+}
+
+// listLine returns the line listing c in the picker, cut to width, in bold
+// with a cursor if selected.
+func listLine(c *cmd.Command, selected bool, width int) string {
+	line := []rune(fmt.Sprintf("%-20s %-10s %s", c.Alias, c.Group, c.Synopsis()))
+	if max := width - 2; len(line) > max {
+		if max < 0 {
+			max = 0
+		}
+		line = line[:max]
+	}
+	if selected {
+		return "\033[1m> " + string(line) + "\033[0m"
+	}
+	return "  " + string(line)
+}
+
+// pickCommand lets the user pick one of cmds from a list they can filter by
+// typing, previewing the usage of the selected one. It returns nil if they
+// cancel.
+func pickCommand(t *terminal, cmds []*cmd.Command) (*cmd.Command, error) {
+	var all []*cmd.Command
+	for _, c := range cmds {
+		if c.Alias != "" {
+			all = append(all, c)
+		}
+	}
+
+	query := []rune{}
+	selected := 0
+	usages := map[*cmd.Command]string{}
+	defer fmt.Fprint(t.out, "\033[H\033[2J")
+
+	for {
+		matches := filterCommands(all, string(query))
+		if selected >= len(matches) {
+			selected = len(matches) - 1
+		}
+		if selected < 0 {
+			selected = 0
+		}
+
+		width, height := t.size()
+		listHeight := len(matches)
+		if max := height / 3; listHeight > max {
+			listHeight = max
+		}
+		first := 0
+		if selected >= listHeight {
+			first = selected - listHeight + 1
+		}
+
+		var b strings.Builder
+		b.WriteString("\033[H\033[2J")
+		fmt.Fprintf(&b, "> %s\n", string(query))
+		for i := first; i < first+listHeight; i++ {
+			b.WriteString(listLine(matches[i], i == selected, width) + "\n")
+		}
+		fmt.Fprintf(&b, "  %d/%d\n", len(matches), len(all))
+
+		if len(matches) > 0 {
+			c := matches[selected]
+			if _, ok := usages[c]; !ok {
+				usages[c] = c.Usage()
+			}
+			preview := strings.Split(strings.Trim(usages[c], "\n"), "\n")
+			if max := height - listHeight - 3; max < 0 {
+				preview = nil
+			} else if len(preview) > max {
+				preview = preview[:max]
+			}
+			b.WriteString(strings.Join(preview, "\n"))
+		}
+		t.printLines(b.String())
+		// Leave the cursor after the query.
+		fmt.Fprintf(t.out, "\033[1;%dH", len(string(query))+3)
+
+		key, r, err := t.readKey()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case keyCancel:
+			return nil, nil
+		case keyEnter:
+			if len(matches) > 0 {
+				return matches[selected], nil
+			}
+		case keyUp:
+			selected--
+		case keyDown:
+			selected++
+		case keyBackspace:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+			}
+		case keyClear:
+			query = query[:0]
+		default:
+			if r != 0 {
+				query = append(query, r)
+				selected = 0
+			}
+		}
+	}
+}
+
+// errCancelled is returned when the user cancels a prompt.
+var errCancelled = fmt.Errorf("cancelled")
+
+// promptLine prompts for a line of input, prefilled with value. If mask is
+// set, the input is shown as asterisks.
+func promptLine(t *terminal, prompt, value string, mask bool) (string, error) {
+	line := []rune(value)
+	for {
+		shown := string(line)
+		if mask {
+			shown = strings.Repeat("*", len(line))
+		}
+		fmt.Fprintf(t.out, "\r\033[K%s%s", prompt, shown)
+
+		key, r, err := t.readKey()
+		if err != nil {
+			return "", err
+		}
+		switch key {
+		case keyCancel:
+			fmt.Fprint(t.out, "\r\n")
+			return "", errCancelled
+		case keyEnter:
+			fmt.Fprint(t.out, "\r\n")
+			return string(line), nil
+		case keyBackspace:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		case keyClear:
+			line = line[:0]
+		default:
+			if r != 0 {
+				line = append(line, r)
+			}
+		}
+	}
+}
+
+// promptFlags prompts for the value of each flag in f, prefilled with its
+// default, setting those that are changed. Flags named like secrets aren't
+// prefilled, as their defaults may come from the environment, and their input
+// is masked; leaving them empty keeps the default.
+func promptFlags(t *terminal, f *flag.FlagSet) error {
+	var flags []*flag.Flag
+	f.VisitAll(func(fl *flag.Flag) { flags = append(flags, fl) })
+
+	for _, fl := range flags {
+		prompt := fmt.Sprintf("--%s: ", fl.Name)
+		if fl.Usage != "" {
+			prompt = fmt.Sprintf("--%s (%s): ", fl.Name, fl.Usage)
+		}
+
+		secret := cmd.IsSecretName(fl.Name)
+		prefill := fl.DefValue
+		if secret {
+			prefill = ""
+		}
+
+		for {
+			value, err := promptLine(t, prompt, prefill, secret)
+			if err != nil {
+				return err
+			}
+			if value == prefill {
+				break
+			}
+			if err := f.Set(fl.Name, value); err != nil {
+				fmt.Fprintf(t.out, "invalid value: %s\r\n", err)
+				continue
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// promptMissing prompts on the terminal for the value of name, which a
+// command needs but wasn't given. Prompts are written to stderr, so as not to
+// mix with the output of commands.
+func promptMissing(name string, secret bool) (string, error) {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+
+	t, err := newTerminal(os.Stdin, os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	defer t.restore()
+
+	return promptLine(t, name+": ", "", secret)
+}
+
+// confirmRun shows the warning for a command needing confirmation, and has
+// the user type its alias to run it.
+func confirmRun(alias, warning string) (bool, error) {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+
+	fmt.Fprintf(os.Stderr, "%s\n", warning)
+	t, err := newTerminal(os.Stdin, os.Stderr)
+	if err != nil {
+		return false, err
+	}
+	defer t.restore()
+
+	answer, err := promptLine(t, fmt.Sprintf("Type %s to run it: ", alias), "", false)
+	if err == errCancelled {
+		return false, nil
+	}
+	return answer == alias, err
+}
+
+// promptMu keeps commands running at once from prompting at the same time.
+var promptMu sync.Mutex
+
+// pickAndPrompt lets the user pick one of cmds and give its flags. It returns
+// nil if they cancel.
+func pickAndPrompt(cmds []*cmd.Command) (*cmd.Command, *flag.FlagSet, error) {
+	t, err := newTerminal(os.Stdin, os.Stdout)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer t.restore()
+
+	c, err := pickCommand(t, cmds)
+	if err != nil || c == nil {
+		return nil, nil, err
+	}
+
+	fmt.Fprintf(t.out, "%s\r\n", c.Alias)
+	f := flag.NewFlagSet(c.Alias, flag.ContinueOnError)
+	c.SetFlags(f)
+	if err := promptFlags(t, f); err != nil {
+		if err == errCancelled {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	return c, f, nil
+}
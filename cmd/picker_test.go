@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/commandsmd/cmd"
+)
+
+func TestFuzzyScore(t *testing.T) {
+	for _, tt := range []struct {
+		query, s string
+		score    int
+		ok       bool
+	}{
+		{"", "build", 0, true},
+		{"bld", "build", 2, true},
+		{"BLD", "build", 2, true},
+		{"build", "build", 0, true},
+		{"db", "deploy-db", 7, true},
+		{"ü", "münchen", 1, true},
+		{"ün", "münchen", 1, true},
+		{"dbl", "build", 0, false},
+		{"builds", "build", 0, false},
+	} {
+		score, ok := fuzzyScore(tt.query, tt.s)
+		assert.Equal(t, tt.ok, ok, "%q in %q", tt.query, tt.s)
+		assert.Equal(t, tt.score, score, "%q in %q", tt.query, tt.s)
+	}
+}
+
+func TestFilterCommands(t *testing.T) {
+	build := &cmd.Command{Alias: "build", Help: "Compile the binaries."}
+	deploy := &cmd.Command{Alias: "deploy", Group: "ops", Help: "Roll out a build."}
+	db := &cmd.Command{Alias: "deploy-db", Group: "ops"}
+	lint := &cmd.Command{Alias: "lint"}
+	cmds := []*cmd.Command{lint, deploy, db, build}
+
+	aliases := func(cmds []*cmd.Command) []string {
+		var aliases []string
+		for _, c := range cmds {
+			aliases = append(aliases, c.Alias)
+		}
+		return aliases
+	}
+	assert.Equal(t, []string{"lint", "deploy", "deploy-db", "build"}, aliases(filterCommands(cmds, "")))
+	assert.Equal(t, []string{"deploy", "deploy-db"}, aliases(filterCommands(cmds, "dep")))
+	// Matches in the alias come before those in the group or synopsis.
+	assert.Equal(t, []string{"build", "deploy"}, aliases(filterCommands(cmds, "build")))
+	assert.Equal(t, []string{"deploy"}, aliases(filterCommands(cmds, "roll")))
+	assert.Empty(t, filterCommands(cmds, "xyz"))
+}
+
+func TestListLine(t *testing.T) {
+	c := &cmd.Command{Alias: "grüße", Group: "i18n", Help: "Sagt Grüß Gott."}
+	assert.Equal(t, "  grüße                i18n       Sagt Grüß Gott", listLine(c, false, 80))
+
+	// Lines are cut to the width without splitting characters, and the
+	// selected one is still reset after.
+	line := listLine(c, true, 43)
+	assert.Equal(t, "\033[1m> grüße                i18n       Sagt Grüß\033[0m", line)
+	assert.True(t, utf8.ValidString(line))
+	assert.True(t, strings.HasSuffix(listLine(c, true, 1), "\033[0m"))
+}
+
+func TestPromptFlags(t *testing.T) {
+	f := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	who := f.String("who", "world", "")
+	token := f.String("API_TOKEN", "hunter2", "")
+
+	// Flags named like secrets aren't prefilled, and keep their default
+	// when left empty.
+	var out bytes.Buffer
+	tty := &terminal{out: &out, keys: bufio.NewReader(strings.NewReader("\r\r"))}
+	assert.NoError(t, promptFlags(tty, f))
+	assert.Contains(t, out.String(), "--who: world")
+	assert.NotContains(t, out.String(), "hunter2")
+	assert.Equal(t, "hunter2", *token)
+
+	out.Reset()
+	tty = &terminal{out: &out, keys: bufio.NewReader(strings.NewReader("s3cret\r\x15bob\r"))}
+	assert.NoError(t, promptFlags(tty, f))
+	assert.Equal(t, "bob", *who)
+	assert.Equal(t, "s3cret", *token)
+	assert.Contains(t, out.String(), "--API_TOKEN: ******")
+	assert.NotContains(t, out.String(), "s3cret")
+}
@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A CompiledLanguage describes a language whose code blocks are built into a
+// binary before they are run. Binaries are cached by a hash of the code block,
+// so they are only rebuilt when it changes.
+type CompiledLanguage struct {
+	// Extension is given to the file the code block is written to, e.g. ".go".
+	Extension string
+
+	// Prepare, if set, turns the code block into a complete source file.
+	Prepare func(text string) string
+
+	// Build returns the program and arguments that build the source file at
+	// src into a binary at out. It is run from the directory containing src.
+	// Checking a code block builds it without keeping the binary.
+	Build func(src, out string) []string
+}
+
+var goPackageClause = regexp.MustCompile(`(?m)^\s*package\s+\w+`)
+
+func init() {
+	RegisterCompiledLanguage("go", &CompiledLanguage{
+		Extension: ".go",
+		Prepare: func(text string) string {
+			if goPackageClause.MatchString(text) {
+				return text
+			}
+			// The line directive keeps errors at the lines and
+			// columns of the code block.
+			return "package main; /*line main.go:1:1*/" + text
+		},
+		Build: func(src, out string) []string {
+			return []string{"go", "build", "-o", out, src}
+		},
+	})
+	RegisterCompiledLanguage("rust", &CompiledLanguage{
+		Extension: ".rs",
+		Build: func(src, out string) []string {
+			return []string{"rustc", "-O", "-o", out, src}
+		},
+	})
+	RegisterCompiledLanguage("c", &CompiledLanguage{
+		Extension: ".c",
+		Build: func(src, out string) []string {
+			return []string{"cc", "-O2", "-o", out, src}
+		},
+	})
+}
+
+// RegisterCompiledLanguage makes code blocks in the named language runnable
+// with l, replacing any previous registration for the name.
+func RegisterCompiledLanguage(name string, l *CompiledLanguage) {
+	RegisterLanguage(name, l.New)
+}
+
+// New returns the Language for a code block written in l.
+func (l *CompiledLanguage) New(name, text string) (Language, error) {
+	source := text
+	if l.Prepare != nil {
+		source = l.Prepare(text)
+	}
+
+	return &compiledBlock{name: name, language: l, source: source}, nil
+}
+
+type compiledBlock struct {
+	name     string
+	language *CompiledLanguage
+	source   string
+}
+
+// dirPath returns the directory the block is built in. It is keyed by the
+// language and source, so every change to either gets a fresh build.
+func (b *compiledBlock) dirPath() (string, error) {
+	sum := sha256.Sum256([]byte(b.name + "\x00" + b.source))
+	return cachePath("compiled", hex.EncodeToString(sum[:]))
+}
+
+// dir is like dirPath, but creates the directory if needed.
+func (b *compiledBlock) dir() (string, error) {
+	dir, err := b.dirPath()
+	if err != nil {
+		return "", err
+	}
+	return dir, os.MkdirAll(dir, 0o700)
+}
+
+// writeSource writes the block's source file into dir, returning its name.
+func (b *compiledBlock) writeSource(dir string) (string, error) {
+	src := "main" + b.language.Extension
+	return src, os.WriteFile(filepath.Join(dir, src), []byte(b.source), 0o600)
+}
+
+// buildCmd returns the command that builds src in dir into out.
+func (b *compiledBlock) buildCmd(ctx context.Context, dir, src, out string) (*exec.Cmd, error) {
+	build := b.language.Build(src, out)
+	if len(build) == 0 {
+		return nil, fmt.Errorf("no build command for %s block", b.name)
+	}
+	cmd := exec.CommandContext(ctx, build[0], build[1:]...)
+	cmd.Dir = dir
+	return cmd, nil
+}
+
+// build returns the path to the block's binary, building it first if it isn't
+// already in the cache.
+func (b *compiledBlock) build(ctx context.Context) (string, error) {
+	dir, err := b.dir()
+	if err != nil {
+		return "", err
+	}
+
+	out := filepath.Join(dir, "main")
+	if _, err := os.Stat(out); err == nil {
+		return out, nil
+	}
+
+	src, err := b.writeSource(dir)
+	if err != nil {
+		return "", err
+	}
+
+	// Build next to the final path and rename once done, so a concurrent
+	// run never sees a partially written binary.
+	tmpOut := fmt.Sprintf("main.%d.tmp", os.Getpid())
+	cmd, err := b.buildCmd(ctx, dir, src, tmpOut)
+	if err != nil {
+		return "", err
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(filepath.Join(dir, tmpOut))
+		return "", fmt.Errorf("building %s block failed: %w\n%s", b.name, err, strings.TrimSpace(string(output)))
+	}
+
+	return out, os.Rename(filepath.Join(dir, tmpOut), out)
+}
+
+func (b *compiledBlock) SetExecFlags(f *flag.FlagSet) {}
+
+func (b *compiledBlock) RenderExecCmd(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error) {
+	// A dry run only tells where the binary would be built.
+	build := b.build
+	if IsDryRun(ctx) {
+		build = func(context.Context) (string, error) {
+			dir, err := b.dirPath()
+			return filepath.Join(dir, "main"), err
+		}
+	}
+
+	out, err := build(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return exec.CommandContext(ctx, out, f.Args()...), nil
+}
+
+func (b *compiledBlock) RenderCheckCmd(ctx context.Context) (*exec.Cmd, error) {
+	dir, err := b.dir()
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := b.writeSource(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.buildCmd(ctx, dir, src, os.DevNull)
+}
+
+// DockerArgs mounts the directory the binary is built in, as it is built on
+// the host but has to be visible within the container too.
+func (b *compiledBlock) DockerArgs() ([]string, error) {
+	dir, err := b.dirPath()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-v", dir + ":" + dir + ":ro"}, nil
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/subcommands"
+)
+
+// ExitNotConfirmed is the exit status when a command needing confirmation
+// isn't run, as it was declined or there was no one to ask.
+const ExitNotConfirmed subcommands.ExitStatus = 3
+
+// DangerGroup is the group whose commands all need confirmation.
+const DangerGroup = "danger"
+
+// confirmation returns the warning for a command in group declared with
+// fields, if it needs confirmation: either the confirm field, or a generic
+// one for commands in DangerGroup.
+func confirmation(group string, fields map[string]string) string {
+	if warning, ok := fields["confirm"]; ok && warning != "" {
+		return warning
+	}
+	if _, ok := fields["confirm"]; ok || group == DangerGroup {
+		return "This command is marked as dangerous."
+	}
+	return ""
+}
+
+type confirmedKey struct{}
+
+// confirmPlan confirms each command in plan that needs it, before any of them
+// runs, returning a copy of ctx where they needn't be confirmed again. It
+// fails at the first one that isn't confirmed.
+func confirmPlan(ctx context.Context, plan []*Command) (context.Context, error) {
+	confirmed := map[*Command]bool{}
+	for c := range confirmedFrom(ctx) {
+		confirmed[c] = true
+	}
+	for _, c := range plan {
+		if err := c.confirm(ctx); err != nil {
+			return ctx, err
+		}
+		confirmed[c] = true
+	}
+	return context.WithValue(ctx, confirmedKey{}, confirmed), nil
+}
+
+func confirmedFrom(ctx context.Context) map[*Command]bool {
+	confirmed, _ := ctx.Value(confirmedKey{}).(map[*Command]bool)
+	return confirmed
+}
+
+// confirm returns an error unless c may run: it doesn't need confirmation or
+// was confirmed already, Options.Yes is set or Options.Confirm confirms it.
+func (c *Command) confirm(ctx context.Context) error {
+	if c.Confirm == "" || confirmedFrom(ctx)[c] {
+		return nil
+	}
+
+	opts := optionsFrom(ctx)
+	if opts.Yes {
+		return nil
+	}
+	if opts.Confirm == nil {
+		return fmt.Errorf("%s needs confirmation, pass --yes to run it: %s", c.Alias, c.Confirm)
+	}
+
+	ok, err := opts.Confirm(c.Alias, c.Confirm)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s was not confirmed", c.Alias)
+	}
+	return nil
+}
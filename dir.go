@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rootPrefix starts a dir field relative to the project root rather than to
+// the markdown file, e.g. dir=@root or dir=@root/web.
+const rootPrefix = "@root"
+
+// workDir returns the absolute directory a command defined in inputPath with
+// the given dir field runs in, or "" if it has none and so runs in the current
+// directory. Relative dirs are resolved against the directory containing
+// inputPath, or against Options.Root when they start with @root.
+func workDir(ctx context.Context, inputPath, dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+
+	base := inputDir(inputPath)
+	rel := dir
+	if rel == rootPrefix || strings.HasPrefix(rel, rootPrefix+"/") {
+		if root := optionsFrom(ctx).Root; root != "" {
+			base = root
+		}
+		rel = strings.TrimPrefix(strings.TrimPrefix(rel, rootPrefix), "/")
+	}
+
+	p := filepath.FromSlash(rel)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(base, p)
+	}
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", fmt.Errorf("invalid dir %q: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("invalid dir %q: %s is not a directory", dir, p)
+	}
+	return p, nil
+}
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A dotenv holds the variables read from .env files, along with the paths of
+// the files that were tried, those missing marked as such.
+type dotenv struct {
+	paths  []string
+	values map[string]string
+}
+
+// loadDotenv reads the .env file in dir, then the one for profile if given,
+// .env.<profile>, then the envFiles given explicitly. Variables in later files
+// take precedence. Only explicitly given files need to exist.
+func loadDotenv(dir, profile string, envFiles []string) (*dotenv, error) {
+	env := &dotenv{values: map[string]string{}}
+
+	optional := []string{filepath.Join(dir, ".env")}
+	if profile != "" {
+		optional = append(optional, filepath.Join(dir, ".env."+profile))
+	}
+	for _, p := range optional {
+		err := env.load(p)
+		if os.IsNotExist(err) {
+			env.paths = append(env.paths, p+" (missing)")
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range envFiles {
+		if err := env.load(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return env, nil
+}
+
+func (env *dotenv) load(p string) error {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	env.paths = append(env.paths, p)
+
+	values, err := parseDotenv(b)
+	if err != nil {
+		return fmt.Errorf("%s:%w", p, err)
+	}
+	for name, value := range values {
+		env.values[name] = value
+	}
+	return nil
+}
+
+// lookup returns the value of name, if set in any file.
+func (env *dotenv) lookup(name string) (string, bool) {
+	if env == nil {
+		return "", false
+	}
+	value, ok := env.values[name]
+	return value, ok
+}
+
+// apply passes the variables on to cmd, unless already set in its
+// environment.
+func (env *dotenv) apply(cmd *exec.Cmd) {
+	if env == nil {
+		return
+	}
+
+	names := make([]string, 0, len(env.values))
+	for name := range env.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !hasEnv(cmd, name) {
+			setEnv(cmd, name, env.values[name])
+		}
+	}
+}
+
+// consulted describes the files that were tried, for errors.
+func (env *dotenv) consulted() string {
+	if env == nil || len(env.paths) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (looked in %s)", strings.Join(env.paths, ", "))
+}
+
+// hasEnv reports whether name is set in the environment cmd runs with.
+func hasEnv(cmd *exec.Cmd, name string) bool {
+	if cmd.Env == nil {
+		_, ok := os.LookupEnv(name)
+		return ok
+	}
+	for _, kv := range cmd.Env {
+		if strings.HasPrefix(kv, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+var dotenvLine = regexp.MustCompile(`^\s*(?:export\s+)?([A-Za-z_][A-Za-z0-9_.]*)\s*=\s*(.*)$`)
+
+// parseDotenv parses the NAME=value lines of a .env file. Values may be
+// quoted, with escapes like \n interpreted within double quotes, and
+// unquoted values end at a # preceded by whitespace. Blank lines and those
+// starting with # are ignored.
+func parseDotenv(b []byte) (map[string]string, error) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		m := dotenvLine.FindStringSubmatch(text)
+		if m == nil {
+			return nil, fmt.Errorf("%d: expected NAME=value", line)
+		}
+
+		value, err := parseDotenvValue(m[2])
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", line, err)
+		}
+		values[m[1]] = value
+	}
+	return values, scanner.Err()
+}
+
+func parseDotenvValue(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	switch quote := s[0]; quote {
+	case '\'', '"':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			ch := s[i]
+			switch {
+			case ch == quote:
+				return b.String(), nil
+			case ch == '\\' && quote == '"' && i+1 < len(s):
+				i++
+				switch s[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				default:
+					b.WriteByte(s[i])
+				}
+			default:
+				b.WriteByte(ch)
+			}
+		}
+		return "", fmt.Errorf("unterminated %c", quote)
+	}
+
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.Index(s, "\t#"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s), nil
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// describe returns what running cmd for c would do: the program, its working
+// directory, the variables it changes in the environment and its arguments,
+// which include any script rendered for it. Values of variables that look like
+// secrets, or that come from the variables table, are masked, unless they are
+// just placeholders.
+func (c *Command) describe(cmd *exec.Cmd, upToDate bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s (%s)\n", c.Alias, c.Location())
+	if upToDate {
+		b.WriteString("# up to date, so it would be skipped\n")
+	}
+	if c.Confirm != "" {
+		fmt.Fprintf(&b, "# needs confirmation: %s\n", c.Confirm)
+	}
+
+	fmt.Fprintf(&b, "program: %s\n", cmd.Path)
+
+	dir := cmd.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	fmt.Fprintf(&b, "dir: %s\n", dir)
+
+	if names := changedEnv(cmd); len(names) > 0 {
+		b.WriteString("env:\n")
+		for _, name := range names {
+			value := lookupEnv(cmd, name)
+			if !c.isPlaceholder(name, value) && (c.Variables[name] != nil || IsSecretName(name)) {
+				value = mask(value)
+			}
+			fmt.Fprintf(&b, "  %s=%s\n", name, value)
+		}
+	}
+
+	b.WriteString("argv:\n")
+	for i, arg := range cmd.Args {
+		prefix := fmt.Sprintf("  [%d] ", i)
+		indent := strings.Repeat(" ", len(prefix))
+		lines := strings.Split(strings.TrimRight(arg, "\n"), "\n")
+		for j, line := range lines {
+			if j > 0 {
+				prefix = indent
+			}
+			fmt.Fprintf(&b, "%s%s\n", prefix, line)
+		}
+	}
+
+	return b.String()
+}
+
+// isPlaceholder reports whether value stands in for the value of name, which
+// a dry run doesn't resolve or prompt for.
+func (c *Command) isPlaceholder(name, value string) bool {
+	if v, ok := c.Variables[name]; ok && value == v.placeholder() {
+		return true
+	}
+	return value == promptPlaceholder(name)
+}
+
+// mask hides value, only telling whether it's set.
+func mask(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "********"
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// An envVariable is an environment variable read by a code block. Each one is
+// also exposed as a flag, whose value is passed on through the environment.
+type envVariable struct {
+	// Default is the value the code block falls back to, if any.
+	Default *string
+
+	// Required is set when the code block fails without the variable.
+	Required bool
+}
+
+type envVariables map[string]*envVariable
+
+// findEnvVariables returns the variables referenced by text according to
+// patterns. Each pattern has a "name" group and optionally a "default" group.
+// Matches of requiredPatterns mark the variable as required.
+func findEnvVariables(text string, patterns, requiredPatterns []*regexp.Regexp) envVariables {
+	vars := envVariables{}
+	for _, required := range []bool{false, true} {
+		ps := patterns
+		if required {
+			ps = requiredPatterns
+		}
+
+		for _, p := range ps {
+			for _, m := range p.FindAllStringSubmatchIndex(text, -1) {
+				name := submatch(p, text, m, "name")
+				v, ok := vars[name]
+				if !ok {
+					v = &envVariable{}
+					vars[name] = v
+				}
+
+				if i := p.SubexpIndex("default"); i > 0 && m[2*i] >= 0 && v.Default == nil {
+					d := unquoteLiteral(text[m[2*i]:m[2*i+1]])
+					v.Default = &d
+				}
+				v.Required = v.Required || required
+			}
+		}
+	}
+
+	return vars
+}
+
+// unquoteLiteral returns the value of a string literal, or a number literal as
+// it is.
+func unquoteLiteral(s string) string {
+	if len(s) >= 2 && strings.ContainsRune("\"'`", rune(s[0])) && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+func submatch(p *regexp.Regexp, s string, m []int, name string) string {
+	i := p.SubexpIndex(name)
+	if i < 0 || m[2*i] < 0 {
+		return ""
+	}
+	return s[m[2*i]:m[2*i+1]]
+}
+
+func (vars envVariables) names() []string {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (vars envVariables) setFlags(f *flag.FlagSet) {
+	for _, name := range vars.names() {
+		v := vars[name]
+		defaultValue := os.Getenv(name)
+		if defaultValue == "" && v.Default != nil {
+			defaultValue = *v.Default
+		}
+		f.String(name, defaultValue, fmt.Sprintf("falls back to $%s", name))
+	}
+}
+
+// render passes the flags for vars on to cmd through its environment.
+func (vars envVariables) render(ctx context.Context, cmd *exec.Cmd, f *flag.FlagSet) error {
+	for _, name := range vars.names() {
+		var value string
+		if flag := f.Lookup(name); flag != nil {
+			value = flag.Value.String()
+		}
+
+		if value == "" {
+			if !vars[name].Required {
+				continue
+			}
+
+			var err error
+			value, err = missingValue(ctx, name, fmt.Errorf("option not given: %s", name))
+			if err != nil {
+				return err
+			}
+		}
+
+		setEnv(cmd, name, value)
+	}
+
+	return nil
+}
+
+// setEnv sets name to value in the environment cmd runs with.
+func setEnv(cmd *exec.Cmd, name, value string) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, name+"="+value)
+}
+
+// changedEnv returns the names of the variables that cmd's environment sets
+// to something other than the current process's environment.
+func changedEnv(cmd *exec.Cmd) []string {
+	var names []string
+	seen := map[string]bool{}
+	for i := len(cmd.Env) - 1; i >= 0; i-- {
+		name, value := cmd.Env[i], ""
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value = name[:j], name[j+1:]
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if current, ok := os.LookupEnv(name); !ok || current != value {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
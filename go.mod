@@ -9,5 +9,6 @@ require (
 	github.com/hashicorp/go-getter v1.5.11
 	github.com/stretchr/testify v1.7.1
 	github.com/yuin/goldmark v1.4.12
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
 	mvdan.cc/sh/v3 v3.5.0
 )
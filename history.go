@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+// A HistoryEntry records a run of a command.
+type HistoryEntry struct {
+	Alias     string `json:"alias"`
+	InputPath string `json:"file,omitempty"`
+
+	// Flags are those given explicitly, with the values of those that look
+	// like secrets left out.
+	Flags map[string]string `json:"flags,omitempty"`
+	Args  []string          `json:"args,omitempty"`
+
+	// ScriptHash is a hash of the program and arguments run, which include
+	// any script rendered for the command.
+	ScriptHash string `json:"script_hash"`
+
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	ExitCode int       `json:"exit_code"`
+	User     string    `json:"user,omitempty"`
+	Dir      string    `json:"cwd,omitempty"`
+}
+
+// CommandLine returns the arguments that run the command again, with the
+// same flags and arguments, leaving out the flags that weren't recorded.
+func (e *HistoryEntry) CommandLine() []string {
+	names := make([]string, 0, len(e.Flags))
+	for name := range e.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	line := []string{e.Alias}
+	for _, name := range names {
+		line = append(line, fmt.Sprintf("-%s=%s", name, e.Flags[name]))
+	}
+	if len(e.Args) > 0 {
+		line = append(line, "--")
+		line = append(line, e.Args...)
+	}
+	return line
+}
+
+// historyMu keeps commands running at once from interleaving their entries.
+var historyMu sync.Mutex
+
+// record appends an entry for the run of cmd for c to Options.HistoryFile,
+// if set. Flags for variables from the variables table, or named like
+// secrets, are left out.
+func (c *Command) record(ctx context.Context, f *flag.FlagSet, cmd *exec.Cmd, start time.Time, status subcommands.ExitStatus) error {
+	path := optionsFrom(ctx).HistoryFile
+	if path == "" {
+		return nil
+	}
+
+	e := HistoryEntry{
+		Alias:     c.Alias,
+		InputPath: c.InputPath,
+		Flags:     map[string]string{},
+		Args:      f.Args(),
+		Start:     start,
+		End:       time.Now(),
+		ExitCode:  int(status),
+	}
+	f.Visit(func(fl *flag.Flag) {
+		if _, ok := c.Variables[fl.Name]; !ok && !IsSecretName(fl.Name) {
+			e.Flags[fl.Name] = fl.Value.String()
+		}
+	})
+
+	h := sha256.New()
+	for _, arg := range stableArgs(cmd) {
+		fmt.Fprintf(h, "%q\n", arg)
+	}
+	e.ScriptHash = hex.EncodeToString(h.Sum(nil))
+
+	if u, err := user.Current(); err == nil {
+		e.User = u.Username
+	} else {
+		e.User = os.Getenv("USER")
+	}
+	if cmd.Dir != "" {
+		e.Dir, _ = filepath.Abs(cmd.Dir)
+	} else {
+		e.Dir, _ = os.Getwd()
+	}
+
+	line, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(append(line, '\n')); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// ReadHistory returns the entries recorded in path, oldest first. A missing
+// file has no entries.
+func ReadHistory(path string) ([]*HistoryEntry, error) {
+	in, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	var entries []*HistoryEntry
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		e := &HistoryEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
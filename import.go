@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	mdast "github.com/yuin/goldmark/ast"
+)
+
+// An importDirective pulls the commands defined in another file into the current one.
+// It is declared with either an HTML comment or a link titled cmd-import:
+//
+//	<!-- cmd:import ../shared/ops.md prefix=ops: group=ops -->
+//	[shared commands](../shared/ops.md "cmd-import prefix=ops:")
+//
+// The path is relative to the importing file and may be anything ReadInput
+// accepts. The optional prefix is prepended to the alias of every imported
+// command, and group puts them all in the given group.
+type importDirective struct {
+	path   string
+	prefix string
+	group  string
+}
+
+var importComment = regexp.MustCompile(`(?s)^<!--\s*cmd:import\s+(.*?)\s*-->\s*$`)
+
+const importLinkTitle = "cmd-import"
+
+// parseImport returns the import declared by n, or nil if there is none.
+func parseImport(n mdast.Node, source []byte) (*importDirective, error) {
+	var args string
+	switch v := n.(type) {
+	case *mdast.HTMLBlock:
+		var b strings.Builder
+		for i := 0; i < v.Lines().Len(); i++ {
+			line := v.Lines().At(i)
+			b.Write(line.Value(source))
+		}
+		if v.HasClosure() {
+			b.Write(v.ClosureLine.Value(source))
+		}
+		m := importComment.FindStringSubmatch(strings.TrimSpace(b.String()))
+		if m == nil {
+			return nil, nil
+		}
+		args = m[1]
+	case *mdast.RawHTML:
+		var b strings.Builder
+		for i := 0; i < v.Segments.Len(); i++ {
+			segment := v.Segments.At(i)
+			b.Write(segment.Value(source))
+		}
+		m := importComment.FindStringSubmatch(strings.TrimSpace(b.String()))
+		if m == nil {
+			return nil, nil
+		}
+		args = m[1]
+	case *mdast.Link:
+		title := string(v.Title)
+		if title != importLinkTitle && !strings.HasPrefix(title, importLinkTitle+" ") {
+			return nil, nil
+		}
+		args = fmt.Sprintf("%q %s", v.Destination, strings.TrimPrefix(title, importLinkTitle))
+	default:
+		return nil, nil
+	}
+
+	tokens, err := tokenizeInfo(args)
+	if err != nil {
+		return nil, err
+	}
+
+	imp := &importDirective{}
+	for _, t := range tokens {
+		switch {
+		case !t.hasValue && imp.path == "":
+			imp.path = t.text
+		case t.hasValue && t.text == "prefix":
+			imp.prefix = t.value
+		case t.hasValue && t.text == "group":
+			imp.group = t.value
+		default:
+			return nil, fmt.Errorf("unexpected argument to import: %q", t.text)
+		}
+	}
+	if imp.path == "" {
+		return nil, fmt.Errorf("import without a path")
+	}
+
+	return imp, nil
+}
+
+// nodeStart returns the offset into the source where n starts, as far as can
+// be told.
+func nodeStart(n mdast.Node) int {
+	for ; n != nil; n = n.FirstChild() {
+		if n.Type() == mdast.TypeBlock && n.Lines().Len() > 0 {
+			return n.Lines().At(0).Start
+		}
+		if t, ok := n.(*mdast.Text); ok {
+			return t.Segment.Start
+		}
+		if r, ok := n.(*mdast.RawHTML); ok && r.Segments.Len() > 0 {
+			return r.Segments.At(0).Start
+		}
+	}
+	return 0
+}
+
+// importer follows imports while parsing command definitions, keeping track
+// of the files being imported to detect cycles.
+type importer struct {
+	stack    []string
+	imported map[importDirective]bool
+}
+
+func newImporter() *importer {
+	return &importer{imported: map[importDirective]bool{}}
+}
+
+// resolveImport resolves target relative to the file it is imported from.
+func resolveImport(from, target string) string {
+	if from == "" || from == "<stdin>" || filepath.IsAbs(target) || strings.Contains(target, "://") || strings.HasPrefix(target, ".../") {
+		return target
+	}
+
+	if strings.Contains(from, "://") {
+		base, err := url.Parse(from)
+		if err != nil {
+			return target
+		}
+		ref, err := url.Parse(target)
+		if err != nil {
+			return target
+		}
+		return base.ResolveReference(ref).String()
+	}
+
+	return filepath.Join(filepath.Dir(from), target)
+}
+
+// importKey identifies a file independently of how its path was written.
+func importKey(p string) string {
+	if strings.Contains(p, "://") {
+		return p
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
+
+func (im *importer) follow(from string, imp *importDirective) ([]CommandDefinition, error) {
+	target := resolveImport(from, imp.path)
+	key := importKey(target)
+
+	for i, p := range im.stack {
+		if p == key {
+			cycle := append(append([]string{}, im.stack[i:]...), key)
+			return nil, fmt.Errorf("import cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	// The same file imported the same way twice would only define the same
+	// commands twice.
+	seen := importDirective{path: key, prefix: imp.prefix, group: imp.group}
+	if im.imported[seen] {
+		return nil, nil
+	}
+	im.imported[seen] = true
+
+	inputPath, source, err := ReadInput(target)
+	if err != nil {
+		return nil, fmt.Errorf("importing %s: %w", imp.path, err)
+	}
+
+	if len(im.stack) == 0 && from != "" {
+		im.stack = append(im.stack, importKey(from))
+	}
+	im.stack = append(im.stack, key)
+	defer func() { im.stack = im.stack[:len(im.stack)-1] }()
+
+	defs, err := im.parse(inputPath, source)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range defs {
+		defs[i].Name = imp.prefix + defs[i].Name
+		if imp.group != "" {
+			defs[i].Group = imp.group
+		}
+	}
+
+	return defs, nil
+}
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseInfo parses the info string of a fenced code block into its language
+// and fields. Fields are whitespace-separated key=value pairs, where values
+// may be quoted with '...' or "..." and characters escaped with a backslash:
+//
+//	bash group=ops description="build the thing"
+//
+// The attribute syntax used by Pandoc is supported as well, where the first
+// .class gives the language and #id gives the id field:
+//
+//	{.bash group=ops}
+//	bash {#build description="build the thing"}
+func parseInfo(info string) (string, map[string]string, error) {
+	tokens, err := tokenizeInfo(info)
+	if err != nil {
+		return "", nil, err
+	}
+
+	language := ""
+	fields := map[string]string{}
+	for i, t := range tokens {
+		if t.attribute {
+			switch {
+			case strings.HasPrefix(t.text, ".") && !t.quoted:
+				if language == "" {
+					language = t.text[1:]
+				}
+				continue
+			case strings.HasPrefix(t.text, "#") && !t.quoted:
+				fields["id"] = t.text[1:]
+				continue
+			}
+		} else if i == 0 && !t.hasValue {
+			language = t.text
+			continue
+		}
+
+		fields[t.text] = t.value
+	}
+
+	return language, fields, nil
+}
+
+type infoToken struct {
+	text     string
+	value    string
+	hasValue bool
+
+	// quoted is set if any part of text was quoted or escaped.
+	quoted bool
+
+	// attribute is set for tokens within {...}.
+	attribute bool
+}
+
+func tokenizeInfo(info string) ([]infoToken, error) {
+	var tokens []infoToken
+	inAttributes := false
+
+	i := 0
+	for i < len(info) {
+		ch := info[i]
+		switch {
+		case ch == ' ' || ch == '\t':
+			i++
+			continue
+		case ch == '{' && !inAttributes:
+			inAttributes = true
+			i++
+			continue
+		case ch == '}' && inAttributes:
+			inAttributes = false
+			i++
+			continue
+		}
+
+		t := infoToken{attribute: inAttributes}
+		var b strings.Builder
+		target := &t.text
+		flush := func() {
+			*target = b.String()
+			b.Reset()
+		}
+
+	word:
+		for i < len(info) {
+			ch := info[i]
+			switch {
+			case ch == ' ' || ch == '\t':
+				break word
+			case ch == '}' && inAttributes:
+				break word
+			case ch == '=' && !t.hasValue:
+				flush()
+				t.hasValue = true
+				target = &t.value
+				i++
+			case ch == '\\':
+				if i+1 >= len(info) {
+					return nil, fmt.Errorf("unterminated escape in info string: %q", info)
+				}
+				t.quoted = true
+				b.WriteByte(info[i+1])
+				i += 2
+			case ch == '\'' || ch == '"':
+				end, s, err := readQuoted(info, i)
+				if err != nil {
+					return nil, err
+				}
+				t.quoted = true
+				b.WriteString(s)
+				i = end
+			default:
+				b.WriteByte(ch)
+				i++
+			}
+		}
+		flush()
+
+		tokens = append(tokens, t)
+	}
+
+	if inAttributes {
+		return nil, fmt.Errorf("unterminated { in info string: %q", info)
+	}
+
+	return tokens, nil
+}
+
+// readQuoted reads the quoted string starting at info[start], returning the
+// index just after the closing quote and the unquoted contents. Backslash
+// escapes are only interpreted within double quotes.
+func readQuoted(info string, start int) (int, string, error) {
+	quote := info[start]
+	var b strings.Builder
+	for i := start + 1; i < len(info); i++ {
+		ch := info[i]
+		switch {
+		case ch == quote:
+			return i + 1, b.String(), nil
+		case ch == '\\' && quote == '"' && i+1 < len(info):
+			i++
+			b.WriteByte(info[i])
+		default:
+			b.WriteByte(ch)
+		}
+	}
+
+	return 0, "", fmt.Errorf("unterminated %c in info string: %q", quote, info)
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os/exec"
+	"regexp"
+)
+
+// A Language runs and checks a single code block. Each code block gets its
+// own Language, created by the LanguageFunc registered for the language
+// named in the block's info string.
+type Language interface {
+	// SetExecFlags declares the flags accepted by the code block.
+	SetExecFlags(f *flag.FlagSet)
+
+	// RenderExecCmd renders the command that runs the code block, given the
+	// parsed flags and the arguments passed to Command.Execute. When
+	// IsDryRun(ctx), it must not have side effects such as building or
+	// writing files.
+	RenderExecCmd(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error)
+
+	// RenderCheckCmd renders the command that checks the code block for
+	// syntax errors, or returns nil if the language has no way to do so.
+	RenderCheckCmd(ctx context.Context) (*exec.Cmd, error)
+}
+
+// A ContainerLanguage is a Language that needs extra arguments to docker run
+// when its code block is run within a container, e.g. to mount files it
+// writes on the host.
+type ContainerLanguage interface {
+	Language
+
+	DockerArgs() ([]string, error)
+}
+
+// A LanguageFunc returns the Language for a code block. name is the language
+// given in the block's info string and text is the block's contents.
+type LanguageFunc func(name, text string) (Language, error)
+
+var languages = map[string]LanguageFunc{
+	"bash":   newShellLanguage,
+	"sh":     newShellLanguage,
+	"shell":  newShellLanguage,
+	"python": newPythonLanguage,
+	"node":   newNodeLanguage,
+}
+
+// RegisterLanguage makes code blocks in the named language runnable, replacing
+// any previous registration for the name. It is meant to be called before
+// any commands are parsed, typically from an init function.
+func RegisterLanguage(name string, fn LanguageFunc) {
+	languages[name] = fn
+}
+
+// LookupLanguage returns the LanguageFunc registered for name.
+func LookupLanguage(name string) (LanguageFunc, bool) {
+	fn, ok := languages[name]
+	return fn, ok
+}
+
+// defaultLiteral matches the string or number literal a variable defaults
+// to, which findEnvVariables unquotes.
+const defaultLiteral = `(?P<default>"[^"]*"|'[^']*'|` + "`[^`]*`" + `|-?\d+(?:\.\d+)?)`
+
+// Python code blocks take flags for the environment variables they read.
+// Variables read with os.environ[...] are required, the others are optional
+// and may provide a default.
+var pythonEnvPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`os\.(?:environ\.get|environ\.setdefault|getenv)\(\s*["'](?P<name>\w+)["']\s*(?:,\s*(?:` + defaultLiteral + `\s*)?[^)]*)?\)`),
+}
+
+var pythonRequiredEnvPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`os\.environ\[\s*["'](?P<name>\w+)["']\s*\]`),
+}
+
+type pythonLanguage struct {
+	name string
+	text string
+	vars envVariables
+}
+
+func newPythonLanguage(name, text string) (Language, error) {
+	return &pythonLanguage{
+		name: name,
+		text: text,
+		vars: findEnvVariables(text, pythonEnvPatterns, pythonRequiredEnvPatterns),
+	}, nil
+}
+
+func (l *pythonLanguage) SetExecFlags(f *flag.FlagSet) {
+	l.vars.setFlags(f)
+}
+
+func (l *pythonLanguage) RenderExecCmd(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error) {
+	// From the python manual page:
+	//   -c command
+	//          Specify the command to execute (see next section).  This terminates the option list (following options are passed as arguments to the command).
+	cmd := exec.CommandContext(ctx, l.name, append([]string{"-c", l.text, fmt.Sprint(args[0])}, f.Args()...)...)
+	if err := l.vars.render(ctx, cmd, f); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func (l *pythonLanguage) RenderCheckCmd(ctx context.Context) (*exec.Cmd, error) {
+	return exec.CommandContext(ctx, l.name, "-c", "import ast, sys; ast.parse(sys.argv[1])", l.text), nil
+}
+
+// Node code blocks take flags for the environment variables they read from
+// process.env, with a default when one is given using ?? or ||.
+var nodeEnvPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`process\.env\.(?P<name>[A-Za-z_]\w*)(?:\s*(?:\?\?|\|\|)\s*` + defaultLiteral + `)?`),
+	regexp.MustCompile(`process\.env\[\s*["'` + "`" + `](?P<name>\w+)["'` + "`" + `]\s*\](?:\s*(?:\?\?|\|\|)\s*` + defaultLiteral + `)?`),
+}
+
+type nodeLanguage struct {
+	name string
+	text string
+	vars envVariables
+}
+
+func newNodeLanguage(name, text string) (Language, error) {
+	return &nodeLanguage{
+		name: name,
+		text: text,
+		vars: findEnvVariables(text, nodeEnvPatterns, nil),
+	}, nil
+}
+
+func (l *nodeLanguage) SetExecFlags(f *flag.FlagSet) {
+	l.vars.setFlags(f)
+}
+
+func (l *nodeLanguage) RenderExecCmd(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, l.name, append([]string{"--eval", l.text, "--", fmt.Sprint(args[0])}, f.Args()...)...)
+	if err := l.vars.render(ctx, cmd, f); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func (l *nodeLanguage) RenderCheckCmd(ctx context.Context) (*exec.Cmd, error) {
+	return exec.CommandContext(ctx, l.name, "--eval", `const vm = require('vm'); new vm.Script(process.argv[1])`, "--", l.text), nil
+}
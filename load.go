@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	getter "github.com/hashicorp/go-getter"
+)
+
+// DiscoverInputs returns the markdown files defining commands for dir: its
+// README.md, if any, followed by every *.md file under its commands directory.
+func DiscoverInputs(dir string) ([]string, error) {
+	var inputs []string
+
+	readme := filepath.Join(dir, "README.md")
+	if _, err := os.Stat(readme); err == nil {
+		inputs = append(inputs, readme)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	commandsDir := filepath.Join(dir, "commands")
+	err := filepath.WalkDir(commandsDir, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if p == commandsDir && errors.Is(err, os.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		if !e.IsDir() && filepath.Ext(p) == ".md" {
+			inputs = append(inputs, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("no README.md or commands/*.md found in %s", dir)
+	}
+
+	return inputs, nil
+}
+
+// ParseCommandsFile is like ParseCommands, but records inputPath as the file
+// the commands were defined in and resolves imports relative to it.
+func ParseCommandsFile(inputPath string, source []byte) ([]*Command, error) {
+	defs, err := ParseCommandDefinitionsFile(inputPath, source)
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := []*Command{}
+	for _, d := range defs {
+		cmd, err := d.Parse()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	return cmds, nil
+}
+
+// MergeCommands concatenates the given sets of commands, failing if more than
+// one command has the same alias.
+func MergeCommands(sets ...[]*Command) ([]*Command, error) {
+	merged := []*Command{}
+	byAlias := map[string]*Command{}
+	for _, cmds := range sets {
+		for _, cmd := range cmds {
+			if cmd.Alias != "" {
+				if previous, ok := byAlias[cmd.Alias]; ok {
+					return nil, fmt.Errorf("%s: command %q is already defined at %s", cmd.Location(), cmd.Alias, previous.Location())
+				}
+				byAlias[cmd.Alias] = cmd
+			}
+			merged = append(merged, cmd)
+		}
+	}
+
+	return merged, nil
+}
+
+// Location returns where c is defined as file:line:col.
+func (c *Command) Location() string {
+	return c.Pos.String()
+}
+
+// ReadInput reads the markdown file at inputPath, returning the path it was
+// actually read from along with its contents. inputPath may be - for stdin,
+// .../NAME for the first file called NAME in the current directory or one of
+// its parents, or anything go-getter can fetch, such as a URL.
+func ReadInput(inputPath string) (string, []byte, error) {
+	if inputPath == "-" {
+		source, err := io.ReadAll(os.Stdin)
+		return "<stdin>", source, err
+	}
+
+	if strings.HasPrefix(inputPath, ".../") {
+		marker := strings.TrimPrefix(inputPath, ".../")
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", nil, err
+		}
+
+		dir, err := UpWhere(cwd, marker)
+		if err != nil {
+			return "", nil, err
+		}
+		inputPath = path.Join(dir, marker)
+	}
+
+	f, err := os.Open(inputPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			source, err := readFromURL(inputPath)
+			return inputPath, source, err
+		}
+		return "", nil, err
+	}
+	defer f.Close()
+
+	source, err := io.ReadAll(f)
+	return inputPath, source, err
+}
+
+func readFromURL(url string) ([]byte, error) {
+	f, err := ioutil.TempFile("", "*.md")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(f.Name())
+	f.Close()
+	err = getter.GetFile(f.Name(), url)
+	if err != nil {
+		return nil, err
+	}
+
+	// go-getter may replace the file rather than write to it, so read it
+	// back by name.
+	return os.ReadFile(f.Name())
+}
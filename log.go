@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// logDir returns the directory the output of c is logged to, if any: the one
+// given by its log field, relative to the markdown file defining it, or else
+// Options.LogDir. A log field without a directory logs to .cmd/logs next to
+// the markdown file.
+func (c *Command) logDir(ctx context.Context) string {
+	switch c.Log {
+	case "":
+		return optionsFrom(ctx).LogDir
+	case "true":
+		return filepath.Join(c.baseDir(), stateDir, "logs")
+	case "false":
+		return ""
+	}
+	if filepath.IsAbs(c.Log) {
+		return c.Log
+	}
+	return filepath.Join(c.baseDir(), c.Log)
+}
+
+// logField returns the log field of an info string, where a bare log enables
+// logging to the default directory.
+func logField(fields map[string]string) string {
+	value, ok := fields["log"]
+	if ok && value == "" {
+		return "true"
+	}
+	return value
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// teeLog returns stdio with its output also written to a new log file for c,
+// if its output is logged, and a function closing the file once done. The
+// command still reads from the same input, but its output is no longer a
+// terminal.
+func (c *Command) teeLog(ctx context.Context, std stdio, start time.Time) (stdio, func() error, error) {
+	dir := c.logDir(ctx)
+	if dir == "" {
+		return std, func() error { return nil }, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return std, nil, err
+	}
+	name := fmt.Sprintf("%s-%s.log", unsafeFileChars.ReplaceAllString(c.Alias, "_"), start.Format("20060102-150405.000"))
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return std, nil, err
+	}
+	fmt.Fprintf(std.err, "logging output to %s\n", path)
+
+	return stdio{
+		in:  std.in,
+		out: io.MultiWriter(std.out, f),
+		err: io.MultiWriter(std.err, f),
+	}, f.Close, nil
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// An environment is where values that weren't given as flags or in the
+// process environment are looked up, for a command defined in a given file.
+type environment struct {
+	dotenv    *dotenv
+	variables map[string]*VariableSource
+
+	// found holds the values missingValue already found, so that each is
+	// only looked up, or prompted for, once.
+	found map[string]string
+}
+
+type environmentKey struct{}
+
+// withEnvironment returns a copy of ctx where values missing for a command
+// are looked up in env.
+func withEnvironment(ctx context.Context, env *environment) context.Context {
+	return context.WithValue(ctx, environmentKey{}, env)
+}
+
+func environmentFrom(ctx context.Context) *environment {
+	if env, ok := ctx.Value(environmentKey{}).(*environment); ok {
+		return env
+	}
+	return &environment{}
+}
+
+// loadEnvironment returns the environment for a command defined in
+// inputPath.
+func loadEnvironment(ctx context.Context, inputPath string, variables map[string]*VariableSource) (*environment, error) {
+	opts := optionsFrom(ctx)
+	env, err := loadDotenv(inputDir(inputPath), opts.Profile, opts.EnvFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &environment{dotenv: env, variables: variables, found: map[string]string{}}, nil
+}
+
+// flags returns a copy of f, with flags made by setFlags, to render a command
+// with. Flags that weren't given take their values from .env files over their
+// defaults, unless set in the process environment. f itself is left alone, so
+// that those values aren't taken as given, as by history.
+func (env *environment) flags(f *flag.FlagSet, setFlags func(*flag.FlagSet)) (*flag.FlagSet, error) {
+	flags := flag.NewFlagSet(f.Name(), flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	setFlags(flags)
+
+	given := map[string]bool{}
+	var err error
+	f.Visit(func(fl *flag.Flag) {
+		given[fl.Name] = true
+		if flags.Lookup(fl.Name) != nil && err == nil {
+			err = flags.Set(fl.Name, fl.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	flags.VisitAll(func(fl *flag.Flag) {
+		if given[fl.Name] || err != nil {
+			return
+		}
+		if _, ok := os.LookupEnv(fl.Name); ok {
+			return
+		}
+		if value, ok := env.dotenv.lookup(fl.Name); ok {
+			if setErr := flags.Set(fl.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value for %s%s: %w", fl.Name, env.dotenv.consulted(), setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return flags, flags.Parse(append([]string{"--"}, f.Args()...))
+}
+
+// apply passes on the variables from .env files to cmd.
+func (env *environment) apply(cmd *exec.Cmd) {
+	env.dotenv.apply(cmd)
+}
+
+// missingValue returns a value for name, which is required but wasn't given,
+// from .env files or the variables table of the markdown file, or else by
+// prompting for it with Options.Prompt. Without a way to prompt, or if the
+// answer is empty, it fails with err, noting the .env files read. In a dry
+// run, it neither resolves variables nor prompts, returning a placeholder
+// instead.
+func missingValue(ctx context.Context, name string, err error) (string, error) {
+	env := environmentFrom(ctx)
+	if value, ok := env.found[name]; ok {
+		return value, nil
+	}
+	value, err := env.missingValue(ctx, name, err)
+	if err == nil && env.found != nil {
+		env.found[name] = value
+	}
+	return value, err
+}
+
+func (env *environment) missingValue(ctx context.Context, name string, err error) (string, error) {
+	if value, ok := env.dotenv.lookup(name); ok && value != "" {
+		return value, nil
+	}
+	if v, ok := env.variables[name]; ok {
+		if IsDryRun(ctx) {
+			return v.placeholder(), nil
+		}
+		return v.Resolve(ctx)
+	}
+
+	if consulted := env.dotenv.consulted(); consulted != "" {
+		err = fmt.Errorf("%w%s", err, consulted)
+	}
+
+	prompt := optionsFrom(ctx).Prompt
+	if prompt == nil {
+		return "", err
+	}
+	if IsDryRun(ctx) {
+		return promptPlaceholder(name), nil
+	}
+
+	value, promptErr := prompt(name, IsSecretName(name))
+	if promptErr != nil {
+		return "", promptErr
+	}
+	if value == "" {
+		return "", err
+	}
+	return value, nil
+}
+
+// promptPlaceholder stands for the value that would be prompted for in a dry
+// run.
+func promptPlaceholder(name string) string {
+	return fmt.Sprintf("<prompted for %s>", name)
+}
+
+// inputDir returns the directory relative paths are resolved against for
+// commands defined in inputPath: the one containing it, or the current
+// directory if it isn't a local file.
+func inputDir(inputPath string) string {
+	if inputPath == "" || inputPath == "<stdin>" || strings.Contains(inputPath, "://") {
+		return "."
+	}
+	return filepath.Dir(inputPath)
+}
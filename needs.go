@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/subcommands"
+)
+
+// splitList splits a comma-separated list in an info string field, such as
+// the aliases given to needs.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// LinkCommands resolves the commands each of cmds needs, failing if one is
+// not found among cmds or if they form a cycle.
+func LinkCommands(cmds []*Command) error {
+	byAlias := map[string]*Command{}
+	for _, c := range cmds {
+		if c.Alias != "" {
+			byAlias[c.Alias] = c
+		}
+	}
+
+	for _, c := range cmds {
+		c.Dependencies = nil
+		for _, alias := range c.Needs {
+			dep, ok := byAlias[alias]
+			if !ok {
+				return &PositionError{Pos: c.Pos, Err: fmt.Errorf("%s needs unknown command %q", c.Alias, alias)}
+			}
+			c.Dependencies = append(c.Dependencies, dep)
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[*Command]int{}
+	var stack []string
+	var visit func(c *Command) error
+	visit = func(c *Command) error {
+		switch state[c] {
+		case visiting:
+			i := 0
+			for stack[i] != c.Alias {
+				i++
+			}
+			cycle := append(append([]string{}, stack[i:]...), c.Alias)
+			return &PositionError{Pos: c.Pos, Err: fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))}
+		case visited:
+			return nil
+		}
+
+		state[c] = visiting
+		stack = append(stack, c.Alias)
+		for _, dep := range c.Dependencies {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[c] = visited
+		return nil
+	}
+
+	for _, c := range cmds {
+		if err := visit(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Plan returns the commands that need to run before c, transitively and
+// without duplicates, with every command after the ones it needs.
+func (c *Command) Plan() []*Command {
+	plan := planFor([]*Command{c})
+	return plan[:len(plan)-1]
+}
+
+// planFor returns cmds along with the commands they need, transitively and
+// without duplicates, with every command after the ones it needs.
+func planFor(cmds []*Command) []*Command {
+	var plan []*Command
+	seen := map[*Command]bool{}
+	var visit func(c *Command)
+	visit = func(c *Command) {
+		if seen[c] {
+			return
+		}
+		seen[c] = true
+		for _, dep := range c.Dependencies {
+			visit(dep)
+		}
+		plan = append(plan, c)
+	}
+	for _, c := range cmds {
+		visit(c)
+	}
+	return plan
+}
+
+// executeDependencies runs the commands c needs, with the defaults for all
+// their flags. It stops at the first one that fails, returning its status.
+func (c *Command) executeDependencies(ctx context.Context) subcommands.ExitStatus {
+	return runPlan(ctx, c.Plan(), c.Alias)
+}
+
+// executeDefaults runs c with the defaults for all its flags.
+func (c *Command) executeDefaults(ctx context.Context, stdio stdio) subcommands.ExitStatus {
+	f := flag.NewFlagSet(c.Alias, flag.ContinueOnError)
+	f.SetOutput(io.Discard)
+	c.SetFlags(f)
+	if err := f.Parse(nil); err != nil {
+		fmt.Fprintf(stdio.err, "fatal: %s\n", err)
+		return subcommands.ExitUsageError
+	}
+
+	return c.execute(ctx, f, stdio, c.Alias)
+}
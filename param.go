@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Types of parameters that may be declared in a code block's info string.
+const (
+	ParamString = "string"
+	ParamInt    = "int"
+	ParamBool   = "bool"
+	ParamEnum   = "enum"
+)
+
+// A Param is a parameter declared in a code block's info string, e.g.
+//
+//	```bash param:env=staging|prod param:count:int=3 help:count="How many"
+//
+// The key is param:NAME, optionally followed by :TYPE, and by ! when the
+// parameter is required. The value is the default, or the choices for an enum
+// separated by |, the first of which is the default. Each parameter becomes a
+// flag, and its value is passed to the command in the environment variable
+// NAME.
+type Param struct {
+	Name     string
+	Type     string
+	Choices  []string
+	Default  string
+	Required bool
+	Help     string
+}
+
+func parseParams(fields map[string]string) ([]*Param, error) {
+	params := []*Param{}
+	helps := map[string]string{}
+	for key, value := range fields {
+		if strings.HasPrefix(key, "help:") {
+			helps[strings.TrimPrefix(key, "help:")] = value
+			continue
+		}
+
+		if !strings.HasPrefix(key, "param:") {
+			continue
+		}
+
+		p, err := parseParam(strings.TrimPrefix(key, "param:"), value)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, p)
+	}
+
+	sort.Slice(params, func(i, j int) bool { return params[i].Name < params[j].Name })
+
+	for _, p := range params {
+		p.Help = helps[p.Name]
+		delete(helps, p.Name)
+	}
+	for name := range helps {
+		return nil, fmt.Errorf("help given for undeclared param: %s", name)
+	}
+
+	return params, nil
+}
+
+func parseParam(key, value string) (*Param, error) {
+	p := &Param{Type: ParamString}
+	if strings.HasSuffix(key, "!") {
+		p.Required = true
+		key = strings.TrimSuffix(key, "!")
+	}
+
+	split := strings.SplitN(key, ":", 2)
+	p.Name = split[0]
+	if p.Name == "" {
+		return nil, fmt.Errorf("param without a name: %q", "param:"+key)
+	}
+
+	if len(split) > 1 {
+		p.Type = split[1]
+	} else if strings.Contains(value, "|") {
+		p.Type = ParamEnum
+	}
+
+	switch p.Type {
+	case ParamString:
+		p.Default = value
+	case ParamInt:
+		if value != "" {
+			if _, err := strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("invalid default for int param %s: %q", p.Name, value)
+			}
+		}
+		p.Default = value
+	case ParamBool:
+		if value != "" {
+			if _, err := strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("invalid default for bool param %s: %q", p.Name, value)
+			}
+		}
+		p.Default = value
+	case ParamEnum:
+		p.Choices = strings.Split(value, "|")
+		for _, c := range p.Choices {
+			if c == "" {
+				return nil, fmt.Errorf("invalid choices for enum param %s: %q", p.Name, value)
+			}
+		}
+		if !p.Required {
+			p.Default = p.Choices[0]
+		}
+	default:
+		return nil, fmt.Errorf("unknown type for param %s: %q", p.Name, p.Type)
+	}
+
+	return p, nil
+}
+
+func (p *Param) usage() string {
+	usage := p.Help
+	if p.Type == ParamEnum {
+		usage = strings.TrimSpace(fmt.Sprintf("%s (one of %s)", usage, strings.Join(p.Choices, ", ")))
+	}
+	if p.Required {
+		usage = strings.TrimSpace(usage + " (required)")
+	}
+	return usage
+}
+
+func (p *Param) setFlag(f *flag.FlagSet) {
+	switch p.Type {
+	case ParamInt:
+		var v int
+		if p.Default != "" {
+			v, _ = strconv.Atoi(p.Default)
+		}
+		f.IntVar(&v, p.Name, v, p.usage())
+	case ParamBool:
+		var v bool
+		if p.Default != "" {
+			v, _ = strconv.ParseBool(p.Default)
+		}
+		f.BoolVar(&v, p.Name, v, p.usage())
+	case ParamEnum:
+		f.Var(&enumValue{choices: p.Choices, value: p.Default}, p.Name, p.usage())
+	default:
+		f.String(p.Name, p.Default, p.usage())
+	}
+}
+
+// check returns an error unless value is valid for p's flag.
+func (p *Param) check(value string) error {
+	f := flag.NewFlagSet(p.Name, flag.ContinueOnError)
+	p.setFlag(f)
+	return f.Set(p.Name, value)
+}
+
+// validate checks that the flag for p was given a value if required.
+func (p *Param) validate(f *flag.FlagSet) error {
+	if !p.Required {
+		return nil
+	}
+
+	set := false
+	f.Visit(func(fl *flag.Flag) {
+		if fl.Name == p.Name {
+			set = true
+		}
+	})
+	if !set {
+		return fmt.Errorf("option not given: %s", p.Name)
+	}
+	return nil
+}
+
+// markdown describes p as an item in a markdown list.
+func (p *Param) markdown() string {
+	s := fmt.Sprintf("- `--%s` (%s", p.Name, p.Type)
+	if p.Default != "" {
+		s += fmt.Sprintf(", default `%s`", p.Default)
+	}
+	if p.Required {
+		s += ", required"
+	}
+	s += ")"
+	if p.Type == ParamEnum {
+		s += fmt.Sprintf(" one of `%s`", strings.Join(p.Choices, "`, `"))
+	}
+	if p.Help != "" {
+		s += ": " + p.Help
+	}
+	return s
+}
+
+// enumValue is a flag.Value that only accepts one of its choices.
+type enumValue struct {
+	choices []string
+	value   string
+}
+
+func (v *enumValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.value
+}
+
+func (v *enumValue) Set(s string) error {
+	for _, c := range v.choices {
+		if s == c {
+			v.value = s
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(v.choices, ", "))
+}
@@ -1,7 +1,22 @@
 package cmd_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/subcommands"
 
 	"github.com/stretchr/testify/assert"
 
@@ -26,3 +41,1043 @@ func TestParseCommandDefinitions(t *testing.T) {
 		})
 	}
 }
+
+type echoLanguage struct{ text string }
+
+func (l *echoLanguage) SetExecFlags(f *flag.FlagSet) {}
+func (l *echoLanguage) RenderExecCmd(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error) {
+	return exec.CommandContext(ctx, "echo", "-n", l.text), nil
+}
+func (l *echoLanguage) RenderCheckCmd(ctx context.Context) (*exec.Cmd, error) { return nil, nil }
+
+func TestRegisterLanguage(t *testing.T) {
+	cmd.RegisterLanguage("echo", func(name, text string) (cmd.Language, error) {
+		return &echoLanguage{text: text}, nil
+	})
+
+	cmds, err := cmd.ParseCommands([]byte("#### `hello`\n```echo\nhello\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := flag.NewFlagSet("hello", flag.ContinueOnError)
+	cmds[0].SetFlags(f)
+	c, err := cmds[0].RenderExecCmd(context.Background(), f, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := c.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hello\n", string(out))
+
+	_, err = cmd.ParseCommands([]byte("#### `hello`\n```klingon\nhello\n```\n"))
+	assert.EqualError(t, err, "2:1: unknown language for code block: klingon")
+}
+
+func TestParams(t *testing.T) {
+	cmds, err := cmd.ParseCommands([]byte("#### `deploy`\n```bash param:env!=staging|prod param:count:int=3 help:count=replicas\necho $env $count\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cmds[0]
+
+	assert.Equal(t, []*cmd.Param{
+		{Name: "count", Type: cmd.ParamInt, Default: "3", Help: "replicas"},
+		{Name: "env", Type: cmd.ParamEnum, Choices: []string{"staging", "prod"}, Required: true},
+	}, c.Params)
+
+	newFlags := func() *flag.FlagSet {
+		f := flag.NewFlagSet("deploy", flag.ContinueOnError)
+		f.SetOutput(io.Discard)
+		c.SetFlags(f)
+		return f
+	}
+
+	f := newFlags()
+	assert.NoError(t, f.Parse(nil))
+	_, err = c.RenderExecCmd(context.Background(), f, "deploy")
+	assert.EqualError(t, err, "option not given: env (looked in .env (missing))")
+
+	assert.Error(t, newFlags().Parse([]string{"-env=dev"}))
+	assert.Error(t, newFlags().Parse([]string{"-env=prod", "-count=many"}))
+
+	f = newFlags()
+	assert.NoError(t, f.Parse([]string{"-env=prod"}))
+	rendered, err := c.RenderExecCmd(context.Background(), f, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, rendered.Env, "env=prod")
+	assert.Contains(t, rendered.Env, "count=3")
+
+	_, err = cmd.ParseCommands([]byte("#### `deploy`\n```bash param:count:float=3\necho\n```\n"))
+	assert.EqualError(t, err, `2:1: unknown type for param count: "float"`)
+}
+
+func TestParseInfo(t *testing.T) {
+	var cases = []struct {
+		name     string
+		info     string
+		language string
+		fields   map[string]string
+		err      string
+	}{
+		{
+			name:     "empty",
+			info:     "",
+			language: "",
+			fields:   map[string]string{},
+		},
+		{
+			name:     "plain fields",
+			info:     "python  image=python:3.10-slim   group=bad",
+			language: "python",
+			fields:   map[string]string{"image": "python:3.10-slim", "group": "bad"},
+		},
+		{
+			name:     "quoted values",
+			info:     `bash description="build the \"thing\"" mounts='a b' path=c\ d flag`,
+			language: "bash",
+			fields:   map[string]string{"description": `build the "thing"`, "mounts": "a b", "path": "c d", "flag": ""},
+		},
+		{
+			name:     "attributes",
+			info:     `{.python #build .numberLines group=ops description="build it"}`,
+			language: "python",
+			fields:   map[string]string{"id": "build", "group": "ops", "description": "build it"},
+		},
+		{
+			name:     "language with attributes",
+			info:     `bash {group=ops}`,
+			language: "bash",
+			fields:   map[string]string{"group": "ops"},
+		},
+		{
+			name: "unterminated quote",
+			info: `bash description="build`,
+			err:  `unterminated " in info string: "bash description=\"build"`,
+		},
+		{
+			name: "unterminated attributes",
+			info: `{.bash group=ops`,
+			err:  `unterminated { in info string: "{.bash group=ops"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			defs, err := cmd.ParseCommandDefinitions([]byte("#### `c`\n```" + c.info + "\necho\n```\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			language, fields, err := defs[0].ParseInfo()
+			if c.err != "" {
+				assert.EqualError(t, err, c.err)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, c.language, language)
+			assert.Equal(t, c.fields, fields)
+		})
+	}
+}
+
+func TestMergeCommands(t *testing.T) {
+	a, err := cmd.ParseCommandsFile("README.md", []byte("# Commands\n\n#### `build`\n```\nmake\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := cmd.ParseCommandsFile("commands/ops.md", []byte("#### `deploy`\n```\n./deploy\n```\n\n#### `build`\n```\nbazel build\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "README.md:4:1", a[0].Location())
+	assert.Equal(t, "commands/ops.md:2:1", b[0].Location())
+
+	merged, err := cmd.MergeCommands(a, b[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, merged, 2)
+
+	_, err = cmd.MergeCommands(a, b)
+	assert.EqualError(t, err, `commands/ops.md:7:1: command "build" is already defined at README.md:4:1`)
+}
+
+func TestImports(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	write("shared/ops.md", "#### `deploy`\n```\n./deploy\n```\n")
+	readme := write("svc/README.md", "<!-- cmd:import ../shared/ops.md prefix=ops: group=shared -->\n\n#### `build`\n```\nmake\n```\n")
+
+	defs, err := cmd.ParseCommandDefinitionsFile(readme, []byte("<!-- cmd:import ../shared/ops.md prefix=ops: group=shared -->\n\n#### `build`\n```\nmake\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, defs, 2)
+	assert.Equal(t, "ops:deploy", defs[0].Name)
+	assert.Equal(t, "shared", defs[0].Group)
+	assert.Equal(t, filepath.Join(dir, "shared/ops.md"), defs[0].InputPath)
+	assert.Equal(t, "build", defs[1].Name)
+	assert.Equal(t, readme, defs[1].InputPath)
+
+	write("shared/ops.md", "[svc](../svc/README.md \"cmd-import\")\n")
+	source, err := os.ReadFile(readme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cmd.ParseCommandDefinitionsFile(readme, source)
+	assert.ErrorContains(t, err, "import cycle: "+readme+" -> "+filepath.Join(dir, "shared/ops.md")+" -> "+readme)
+}
+
+func TestPositions(t *testing.T) {
+	source := "# Commands\n\n#### `build`\n\n  Builds it.\n\n```bash\necho ok\necho $((1 + ))\n```\n"
+	defs, err := cmd.ParseCommandDefinitionsFile("README.md", []byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := defs[0]
+	assert.Equal(t, cmd.Position{Path: "README.md", Line: 3, Column: 6}, d.HeadingPos)
+	assert.Equal(t, cmd.Position{Path: "README.md", Line: 5, Column: 3}, d.HelpPos)
+	assert.Equal(t, cmd.Position{Path: "README.md", Line: 7, Column: 1}, d.DeclarationPos)
+	assert.Equal(t, cmd.Position{Path: "README.md", Line: 8, Column: 1}, d.CodePos)
+	assert.Equal(t, 7, d.DeclaretionLineStart)
+
+	_, err = d.Parse()
+	var posErr *cmd.PositionError
+	if assert.ErrorAs(t, err, &posErr) {
+		assert.Equal(t, cmd.Position{Path: "README.md", Line: 9, Column: 11}, posErr.Pos)
+	}
+	assert.EqualError(t, err, `README.md:9:11: + must be followed by an expression`)
+}
+
+func TestLinkCommands(t *testing.T) {
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `build`\n```bash needs=gen,lint\nmake\n```\n\n#### `lint`\n```bash needs=gen\nvet\n```\n\n#### `gen`\n```bash\ngenerate\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.LinkCommands(cmds); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := []string{}
+	for _, c := range cmds[0].Plan() {
+		plan = append(plan, c.Alias)
+	}
+	assert.Equal(t, []string{"gen", "lint"}, plan)
+
+	cmds, err = cmd.ParseCommandsFile("README.md", []byte("#### `a`\n```bash needs=b\nx\n```\n\n#### `b`\n```bash needs=a\ny\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, cmd.LinkCommands(cmds), "README.md:2:1: dependency cycle: a -> b -> a")
+
+	cmds[1].Needs = []string{"c"}
+	assert.EqualError(t, cmd.LinkCommands(cmds), `README.md:7:1: b needs unknown command "c"`)
+}
+
+func TestRunCommands(t *testing.T) {
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `all`\n```bash needs=a,b\necho all\n```\n\n#### `a`\n```bash\necho a\n```\n\n#### `b`\n```bash\necho b\n```\n\n#### `fail`\n```bash needs=a\nexit 3\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.LinkCommands(cmds); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	ctx := cmd.WithOptions(context.Background(), &cmd.Options{Jobs: 2, Stdout: &stdout, Stderr: &stderr})
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds[0]))
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	sort.Strings(lines)
+	assert.Equal(t, []string{"a   | a", "all | all", "b   | b"}, lines)
+
+	stdout.Reset()
+	assert.Equal(t, subcommands.ExitStatus(3), cmd.RunCommands(ctx, cmds[3]))
+	assert.Equal(t, "fatal: fail failed with exit status 3\n", stderr.String())
+
+	// By default, commands run one at a time, in order, and their output
+	// isn't prefixed.
+	stdout.Reset()
+	ctx = cmd.WithOptions(context.Background(), &cmd.Options{Stdout: &stdout, Stderr: &stderr})
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds[0]))
+	assert.Equal(t, "a\nb\nall\n", stdout.String())
+}
+
+func TestInferredEnvFlags(t *testing.T) {
+	for _, tt := range []struct {
+		language string
+		code     string
+		defaults map[string]string
+		required []string
+	}{
+		{"python", `import os
+print(os.environ.get("CMDTEST_HOST", "localhost"), os.getenv('CMDTEST_PORT', 8080))
+print(os.getenv("CMDTEST_USER"), os.environ.setdefault("CMDTEST_MODE", "dev"))
+print(os.environ["CMDTEST_TOKEN"])`,
+			map[string]string{"CMDTEST_HOST": "localhost", "CMDTEST_PORT": "8080", "CMDTEST_USER": "", "CMDTEST_MODE": "dev", "CMDTEST_TOKEN": ""},
+			[]string{"CMDTEST_TOKEN"}},
+		{"node", "console.log(process.env.CMDTEST_HOST ?? 'localhost', process.env.CMDTEST_PORT || 8080)\n" +
+			"console.log(process.env['CMDTEST_USER'], process.env[\"CMDTEST_MODE\"] || `dev`, process.env.CMDTEST_TOKEN)",
+			map[string]string{"CMDTEST_HOST": "localhost", "CMDTEST_PORT": "8080", "CMDTEST_USER": "", "CMDTEST_MODE": "dev", "CMDTEST_TOKEN": ""},
+			nil},
+	} {
+		t.Run(tt.language, func(t *testing.T) {
+			cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `run`\n```"+tt.language+"\n"+tt.code+"\n```\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f := flag.NewFlagSet("run", flag.ContinueOnError)
+			cmds[0].SetFlags(f)
+			defaults := map[string]string{}
+			f.VisitAll(func(fl *flag.Flag) { defaults[fl.Name] = fl.DefValue })
+			assert.Equal(t, tt.defaults, defaults)
+
+			_, err = cmds[0].RenderExecCmd(context.Background(), f, "run")
+			for _, name := range tt.required {
+				assert.EqualError(t, err, "option not given: "+name+" (looked in .env (missing))")
+				assert.NoError(t, f.Set(name, "secret"))
+			}
+
+			assert.NoError(t, f.Set("CMDTEST_PORT", "9000"))
+			c, err := cmds[0].RenderExecCmd(context.Background(), f, "run")
+			if assert.NoError(t, err) {
+				assert.Contains(t, c.Env, "CMDTEST_PORT=9000")
+				assert.Contains(t, c.Env, "CMDTEST_HOST=localhost")
+			}
+		})
+	}
+}
+
+func TestTempfileLanguage(t *testing.T) {
+	dir := t.TempDir()
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	scripts := filepath.Join(dir, "cache", "cmd", "scripts")
+
+	// A stand-in for docker that prints its arguments.
+	if err := os.WriteFile(filepath.Join(dir, "docker"), []byte("#!/bin/sh\necho \"$@\"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cmd.RegisterTempfileLanguage("sh-file", &cmd.TempfileLanguage{
+		Extension:   ".sh",
+		Interpreter: []string{"sh", "-e"},
+	})
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `greet`\n```sh-file\necho hi $1\n```\n\n#### `boxed`\n```sh-file image=alpine\necho hi\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	ctx := cmd.WithOptions(context.Background(), &cmd.Options{Jobs: 1, Stdout: &stdout})
+	run := func(c *cmd.Command, args ...string) {
+		f := flag.NewFlagSet(c.Alias, flag.ContinueOnError)
+		c.SetFlags(f)
+		assert.NoError(t, f.Parse(args))
+		assert.Equal(t, subcommands.ExitSuccess, c.Execute(ctx, f, c.Alias))
+	}
+
+	// Scripts are written once, named after their contents.
+	run(cmds[0], "you")
+	run(cmds[0], "again")
+	assert.Equal(t, "hi you\nhi again\n", stdout.String())
+	entries, err := os.ReadDir(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, ".sh", filepath.Ext(entries[0].Name()))
+	}
+
+	// Within containers, the scripts directory is mounted read-only.
+	stdout.Reset()
+	run(cmds[1])
+	quoted := regexp.QuoteMeta(scripts)
+	assert.Regexp(t, `^run -i --rm --init --name cmd-\w+ -v `+quoted+`:`+quoted+`:ro alpine sh -e `+quoted+`/\w+\.sh\n$`, stdout.String())
+
+	// Languages need an interpreter to run their scripts.
+	assert.Panics(t, func() { cmd.RegisterTempfileLanguage("none", &cmd.TempfileLanguage{Extension: ".txt"}) })
+	_, ok := cmd.LookupLanguage("none")
+	assert.False(t, ok)
+}
+
+func TestCheckPosition(t *testing.T) {
+	// A checker reporting an error on the second line, at column 4.
+	cmd.RegisterTempfileLanguage("failing", &cmd.TempfileLanguage{
+		Extension:   ".txt",
+		Interpreter: []string{"cat"},
+		Check:       []string{"sh", "-c", "echo '-:2:4: oops' >&2; exit 1"},
+	})
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("# Tools\n\n#### `bad`\n```failing\nfine\n  oops\n```\n\n#### `py`\n```python\nimport os\nx = = 1\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := cmds[0].Check(context.Background())
+	assert.Equal(t, "-:2:4: oops\n", out)
+	var posErr *cmd.PositionError
+	if assert.True(t, errors.As(err, &posErr)) {
+		assert.Equal(t, cmd.Position{Path: "README.md", Line: 6, Column: 4}, posErr.Pos)
+	}
+
+	if _, err := exec.LookPath("python"); err == nil {
+		_, err := cmds[1].Check(context.Background())
+		if assert.True(t, errors.As(err, &posErr)) {
+			assert.Equal(t, cmd.Position{Path: "README.md", Line: 12, Column: 1}, posErr.Pos)
+		}
+	}
+}
+
+func TestCompiledLanguage(t *testing.T) {
+	dir := t.TempDir()
+	// Go's build cache is kept where it is, despite the other cache
+	// directory.
+	gocache, goErr := exec.Command("go", "env", "GOCACHE").Output()
+	defer os.Setenv("GOCACHE", os.Getenv("GOCACHE"))
+	os.Setenv("GOCACHE", strings.TrimSpace(string(gocache)))
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+
+	// Builds "compile" the source by copying it, logging each build.
+	builds := filepath.Join(dir, "builds")
+	cmd.RegisterCompiledLanguage("script", &cmd.CompiledLanguage{
+		Extension: ".sh",
+		Prepare:   func(text string) string { return "#!/bin/sh\n" + text },
+		Build: func(src, out string) []string {
+			return []string{"sh", "-c", "echo " + src + " >> " + builds + " && cp " + src + " " + out + " && chmod +x " + out}
+		},
+	})
+
+	var stdout bytes.Buffer
+	ctx := cmd.WithOptions(context.Background(), &cmd.Options{Jobs: 1, Stdout: &stdout})
+	parse := func(text string) *cmd.Command {
+		cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `hi`\n```script\n"+text+"\n```\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cmds[0]
+	}
+	countBuilds := func() int {
+		log, _ := os.ReadFile(builds)
+		return strings.Count(string(log), "\n")
+	}
+
+	// Binaries are cached until the code block changes.
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, parse("echo one"), parse("echo one")))
+	assert.Equal(t, "one\none\n", stdout.String())
+	assert.Equal(t, 1, countBuilds())
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, parse("echo two")))
+	assert.Equal(t, 2, countBuilds())
+
+	// Go code blocks may leave out the package clause.
+	if goErr == nil {
+		cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `hello`\n```go\nfunc main() { println(\"hello\") }\n```\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := cmds[0].Check(context.Background())
+		assert.NoError(t, err, out)
+	}
+
+	// Failing to write the source for checking is an error.
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "file"))
+	_, err := parse("echo three").Check(context.Background())
+	assert.Error(t, err)
+
+	// Languages without a build command fail to build.
+	os.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	cmd.RegisterCompiledLanguage("unbuildable", &cmd.CompiledLanguage{
+		Extension: ".txt",
+		Build:     func(src, out string) []string { return nil },
+	})
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `nothing`\n```unbuildable\nfour\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cmds[0].Check(context.Background())
+	assert.EqualError(t, err, "no build command for unbuildable block")
+	f := flag.NewFlagSet("nothing", flag.ContinueOnError)
+	_, err = cmds[0].RenderExecCmd(context.Background(), f, "nothing")
+	assert.EqualError(t, err, "no build command for unbuildable block")
+}
+
+func TestUpToDate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "src", "lib"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", "lib", "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmds, err := cmd.ParseCommandsFile(filepath.Join(dir, "README.md"), []byte("#### `build`\n```bash sources=src/**/*.txt\necho built\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	opts := &cmd.Options{Stdout: &stdout, Stderr: &stderr}
+	ctx := cmd.WithOptions(context.Background(), opts)
+	run := func() string {
+		stdout.Reset()
+		stderr.Reset()
+		assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds...))
+		return stdout.String() + stderr.String()
+	}
+
+	assert.Equal(t, "built\n", run())
+	assert.Equal(t, "build is up to date\n", run())
+
+	if err := os.WriteFile(filepath.Join(dir, "src", "lib", "a.txt"), []byte("b"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "built\n", run())
+
+	opts.Force = true
+	assert.Equal(t, "built\n", run())
+	opts.Force = false
+
+	// Commands whose sources don't exist are never up to date.
+	cmds, err = cmd.ParseCommandsFile(filepath.Join(dir, "README.md"), []byte("#### `gen`\n```bash sources=srcs/*.go outputs=out dir=.\necho generated; touch out\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "generated\n", run())
+	assert.Equal(t, "generated\n", run())
+}
+
+func TestUpToDateInContainer(t *testing.T) {
+	// A stand-in for docker that just runs the command.
+	dir := t.TempDir()
+	docker := "#!/bin/sh\nwhile [ \"$1\" != alpine ]; do shift; done\nshift\nexec \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "docker"), []byte(docker), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmds, err := cmd.ParseCommandsFile(filepath.Join(dir, "README.md"), []byte("#### `build`\n```bash image=alpine sources=a.txt\necho built\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	history := filepath.Join(dir, ".cmd", "history.jsonl")
+	ctx := cmd.WithOptions(context.Background(), &cmd.Options{Stdout: &stdout, Stderr: &stdout, HistoryFile: history})
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds...))
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds...))
+	assert.Equal(t, "built\nbuild is up to date\n", stdout.String())
+
+	ctx = cmd.WithOptions(context.Background(), &cmd.Options{Stdout: io.Discard, HistoryFile: history, Force: true})
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds...))
+	entries, err := cmd.ReadHistory(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, entries[0].ScriptHash, entries[1].ScriptHash)
+	}
+}
+
+func TestPromptMissing(t *testing.T) {
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `deploy`\n```bash param:env!=\nexport API_TOKEN\necho $env $REGION $API_TOKEN\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	opts := &cmd.Options{Stdout: &stdout, Stderr: &stderr}
+	ctx := cmd.WithOptions(context.Background(), opts)
+	assert.Equal(t, subcommands.ExitUsageError, cmd.RunCommands(ctx, cmds...))
+	assert.Contains(t, stderr.String(), "fatal: option not given: env (looked in .env (missing))\n")
+
+	var prompted []string
+	opts.Prompt = func(name string, secret bool) (string, error) {
+		prompted = append(prompted, fmt.Sprintf("%s %v", name, secret))
+		return strings.ToLower(name), nil
+	}
+	os.Unsetenv("API_TOKEN")
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds...))
+	assert.Equal(t, []string{"env false", "API_TOKEN true", "REGION false"}, prompted)
+	assert.Equal(t, "env region api_token\n", stdout.String())
+}
+
+func TestVariables(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "token"), []byte("from file\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved := 0
+	cmd.RegisterResolver("fake", func(ctx context.Context, v *cmd.VariableSource) (string, error) {
+		resolved++
+		return strings.TrimPrefix(v.Source, "fake:"), nil
+	})
+
+	source := "#### `show`\n```bash\nexport SECRET\necho $SECRET, $TOKEN, $SHA, $LIT, $UNUSED\n```\n\n" +
+		"| variable | source |\n| --- | --- |\n| SECRET | fake:hunter2 |\n| TOKEN | file:token |\n| SHA | `$(echo abc)` |\n| LIT | plain |\n| UNUSED | fake:unused |\n"
+	cmds, err := cmd.ParseCommandsFile(filepath.Join(dir, "README.md"), []byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	ctx := cmd.WithOptions(context.Background(), &cmd.Options{Stdout: &stdout})
+	os.Unsetenv("SECRET")
+	os.Setenv("UNUSED", "from env")
+	defer os.Unsetenv("UNUSED")
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds...))
+	assert.Equal(t, "hunter2, from file, abc, plain, from env\n", stdout.String())
+	assert.Equal(t, 1, resolved)
+}
+
+func TestDotenv(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".env":         "# defaults\nexport API_URL=http://dev\nPORT=8080 # inline comment\nMSG=\"a\\nb\"\n",
+		".env.staging": "API_URL='http://staging'\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmds, err := cmd.ParseCommandsFile(filepath.Join(dir, "README.md"), []byte("#### `show`\n```bash\nexport API_URL API_TOKEN\necho $API_URL ${PORT:-none} \"$MSG\"\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	opts := &cmd.Options{Stdout: &stdout, Stderr: &stderr}
+	ctx := cmd.WithOptions(context.Background(), opts)
+	os.Unsetenv("API_URL")
+	os.Unsetenv("PORT")
+	os.Setenv("API_TOKEN", "token")
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds...))
+	assert.Equal(t, "http://dev 8080 a\nb\n", stdout.String())
+
+	stdout.Reset()
+	opts.Profile = "staging"
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds...))
+	assert.Equal(t, "http://staging 8080 a\nb\n", stdout.String())
+
+	os.Unsetenv("API_TOKEN")
+	assert.Equal(t, subcommands.ExitUsageError, cmd.RunCommands(ctx, cmds...))
+	assert.Contains(t, stderr.String(), fmt.Sprintf("fatal: environment variable not set: API_TOKEN (looked in %s, %s)\n",
+		filepath.Join(dir, ".env"), filepath.Join(dir, ".env.staging")))
+
+	stderr.Reset()
+	opts.Profile = "prod"
+	assert.Equal(t, subcommands.ExitUsageError, cmd.RunCommands(ctx, cmds...))
+	assert.Contains(t, stderr.String(), fmt.Sprintf("fatal: environment variable not set: API_TOKEN (looked in %s, %s (missing))\n",
+		filepath.Join(dir, ".env"), filepath.Join(dir, ".env.prod")))
+
+	// Values from .env files take precedence over defaults in the code and
+	// those of params, but not over flags.
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("COLOR=blue\nREGION=eu\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmds, err = cmd.ParseCommandsFile(filepath.Join(dir, "README.md"), []byte("#### `colors`\n```bash param:REGION=us\n: ${COLOR:=red}\necho $COLOR $REGION\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Profile = ""
+	os.Unsetenv("COLOR")
+	os.Unsetenv("REGION")
+	stdout.Reset()
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds...))
+	assert.Equal(t, "blue eu\n", stdout.String())
+
+	f := flag.NewFlagSet("colors", flag.ContinueOnError)
+	cmds[0].SetFlags(f)
+	assert.NoError(t, f.Parse([]string{"-REGION=ap"}))
+	stdout.Reset()
+	assert.Equal(t, subcommands.ExitSuccess, cmds[0].Execute(ctx, f, "colors"))
+	assert.Equal(t, "blue ap\n", stdout.String())
+}
+
+func TestDryRun(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "resolved")
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("| variable | source |\n| --- | --- |\n| API_KEY | $(touch "+marker+"; echo x) |\n\n#### `deploy`\n```bash param:env=dev|prod\necho $env $DB_PASSWORD $API_KEY\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dry runs neither prompt nor resolve variables.
+	var stdout bytes.Buffer
+	ctx := cmd.WithOptions(context.Background(), &cmd.Options{
+		DryRun: true,
+		Stdout: &stdout,
+		Prompt: func(name string, secret bool) (string, error) {
+			t.Errorf("prompted for %s", name)
+			return "hunter2", nil
+		},
+	})
+
+	f := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	cmds[0].SetFlags(f)
+	if err := f.Parse([]string{"-env=prod", "now"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, subcommands.ExitSuccess, cmds[0].Execute(ctx, f, "deploy"))
+
+	bash, _ := exec.LookPath("bash")
+	wd, _ := os.Getwd()
+	assert.Equal(t, "# deploy (README.md:6:1)\n"+
+		"program: "+bash+"\n"+
+		"dir: "+wd+"\n"+
+		"env:\n"+
+		"  API_KEY=<from variables table: $(touch "+marker+"; echo x)>\n"+
+		"  DB_PASSWORD=<prompted for DB_PASSWORD>\n"+
+		"  env=prod\n"+
+		"argv:\n"+
+		"  [0] bash\n"+
+		"  [1] -c\n"+
+		"  [2] echo ${env:=prod} $DB_PASSWORD $API_KEY\n"+
+		"  [3] deploy\n"+
+		"  [4] now\n", stdout.String())
+	assert.NoFileExists(t, marker)
+}
+
+func TestConfirm(t *testing.T) {
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `drop`\n```bash confirm=\"This deletes the prod DB\"\necho dropped\n```\n\n#### `nuke`\n```bash group=danger\necho nuked\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "This deletes the prod DB", cmds[0].Confirm)
+	assert.Equal(t, "This command is marked as dangerous.", cmds[1].Confirm)
+
+	var stdout, stderr bytes.Buffer
+	opts := &cmd.Options{Stdout: &stdout, Stderr: &stderr}
+	ctx := cmd.WithOptions(context.Background(), opts)
+	assert.Equal(t, cmd.ExitNotConfirmed, cmd.RunCommands(ctx, cmds[0]))
+	assert.Contains(t, stderr.String(), "fatal: drop needs confirmation, pass --yes to run it: This deletes the prod DB\n")
+
+	var warnings []string
+	opts.Confirm = func(alias, warning string) (bool, error) {
+		warnings = append(warnings, warning)
+		return alias == "drop", nil
+	}
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds[0]))
+	assert.Equal(t, cmd.ExitNotConfirmed, cmd.RunCommands(ctx, cmds[1]))
+	assert.Equal(t, []string{"This deletes the prod DB", "This command is marked as dangerous."}, warnings)
+
+	opts.Confirm = nil
+	opts.Yes = true
+	stdout.Reset()
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds[1]))
+	assert.Equal(t, "nuked\n", stdout.String())
+
+	// Commands aren't rendered before they're confirmed, so nothing is
+	// prompted for.
+	cmds, err = cmd.ParseCommandsFile("README.md", []byte("#### `rotate`\n```bash confirm\necho $API_TOKEN\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Yes = false
+	opts.Confirm = func(alias, warning string) (bool, error) { return false, nil }
+	opts.Prompt = func(name string, secret bool) (string, error) {
+		t.Errorf("prompted for %s", name)
+		return "", nil
+	}
+	assert.Equal(t, cmd.ExitNotConfirmed, cmd.RunCommands(ctx, cmds[0]))
+
+	// Everything a command needs is confirmed before any of it runs, and
+	// only once.
+	cmds, err = cmd.ParseCommandsFile("README.md", []byte("#### `deploy`\n```bash confirm needs=build,migrate\necho deployed\n```\n\n#### `build`\n```bash\necho built\n```\n\n#### `migrate`\n```bash confirm needs=build\necho migrated\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.LinkCommands(cmds); err != nil {
+		t.Fatal(err)
+	}
+	opts.Prompt = nil
+	var asked []string
+	opts.Confirm = func(alias, warning string) (bool, error) {
+		asked = append(asked, alias)
+		return alias != "deploy", nil
+	}
+	stdout.Reset()
+	f := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	cmds[0].SetFlags(f)
+	assert.Equal(t, cmd.ExitNotConfirmed, cmds[0].Execute(ctx, f, "deploy"))
+	assert.Equal(t, []string{"migrate", "deploy"}, asked)
+	assert.Empty(t, stdout.String())
+
+	asked = nil
+	opts.Confirm = func(alias, warning string) (bool, error) {
+		asked = append(asked, alias)
+		return true, nil
+	}
+	assert.Equal(t, subcommands.ExitSuccess, cmds[0].Execute(ctx, f, "deploy"))
+	assert.Equal(t, []string{"migrate", "deploy"}, asked)
+	assert.Equal(t, "built\nmigrated\ndeployed\n", stdout.String())
+}
+
+func TestHistory(t *testing.T) {
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `greet`\n```bash param:who=world\necho hi $who $1 $API_TOKEN\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), ".cmd", "history.jsonl")
+	ctx := cmd.WithOptions(context.Background(), &cmd.Options{HistoryFile: path, Stdout: io.Discard})
+
+	f := flag.NewFlagSet("greet", flag.ContinueOnError)
+	cmds[0].SetFlags(f)
+	if err := f.Parse([]string{"-who=bob", "-API_TOKEN=hunter2", "there"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, subcommands.ExitSuccess, cmds[0].Execute(ctx, f, "greet"))
+
+	entries, err := cmd.ReadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, entries, 1) {
+		e := entries[0]
+		assert.Equal(t, "greet", e.Alias)
+		assert.Equal(t, "README.md", e.InputPath)
+		assert.Equal(t, 0, e.ExitCode)
+		assert.Len(t, e.ScriptHash, 64)
+		assert.False(t, e.End.Before(e.Start))
+		assert.Equal(t, []string{"greet", "-who=bob", "--", "there"}, e.CommandLine())
+	}
+
+	// Values from the variables table are never recorded, even when
+	// filling in required params.
+	cmds, err = cmd.ParseCommandsFile("README.md", []byte("| variable | source |\n| --- | --- |\n| DB_URL | $(echo postgres://admin:hunter2@db) |\n\n#### `migrate`\n```bash param:DB_URL!\necho $DB_URL\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	ctx = cmd.WithOptions(context.Background(), &cmd.Options{HistoryFile: path, Stdout: &stdout})
+	f = flag.NewFlagSet("migrate", flag.ContinueOnError)
+	cmds[0].SetFlags(f)
+	assert.Equal(t, subcommands.ExitSuccess, cmds[0].Execute(ctx, f, "migrate"))
+	assert.Equal(t, "postgres://admin:hunter2@db\n", stdout.String())
+
+	f = flag.NewFlagSet("migrate", flag.ContinueOnError)
+	cmds[0].SetFlags(f)
+	assert.NoError(t, f.Parse([]string{"-DB_URL=postgres://root:letmein@db"}))
+	assert.Equal(t, subcommands.ExitSuccess, cmds[0].Execute(ctx, f, "migrate"))
+
+	history, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(history), "hunter2")
+	assert.NotContains(t, string(history), "letmein")
+}
+
+func TestLog(t *testing.T) {
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `code:migrate`\n```bash\necho migrated\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	ctx := cmd.WithOptions(context.Background(), &cmd.Options{LogDir: dir, Stdout: &stdout, Stderr: &stderr})
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds...))
+	assert.Equal(t, "migrated\n", stdout.String())
+
+	logs, err := filepath.Glob(filepath.Join(dir, "code_migrate-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, "logging output to "+logs[0]+"\n", stderr.String())
+		b, err := os.ReadFile(logs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "migrated\n", string(b))
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `slow`\n```bash timeout=100ms\nsleep 5\n```\n\n#### `stubborn`\n```bash\ntrap 'echo ignored' TERM\nwhile true; do sleep 0.01; done\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 100*time.Millisecond, cmds[0].Timeout)
+
+	var stdout, stderr bytes.Buffer
+	opts := &cmd.Options{Stdout: &stdout, Stderr: &stderr, GracePeriod: 100 * time.Millisecond}
+	ctx := cmd.WithOptions(context.Background(), opts)
+
+	start := time.Now()
+	assert.Equal(t, cmd.ExitTimeout, cmd.RunCommands(ctx, cmds[0]))
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+	assert.Contains(t, stderr.String(), "fatal: slow timed out after 100ms\n")
+
+	// Commands ignoring SIGTERM are killed after the grace period.
+	opts.Timeout = 100 * time.Millisecond
+	start = time.Now()
+	assert.Equal(t, cmd.ExitTimeout, cmd.RunCommands(ctx, cmds[1]))
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+	assert.Equal(t, "ignored\n", stdout.String())
+}
+
+func TestKillContainer(t *testing.T) {
+	// A stand-in for docker that runs the command, and notes the
+	// containers it's asked to kill.
+	dir := t.TempDir()
+	killed := filepath.Join(dir, "killed")
+	docker := "#!/bin/sh\nif [ \"$1\" = kill ]; then echo \"$2\" >> " + killed + "; exit; fi\nwhile [ \"$1\" != alpine ]; do shift; done\nshift\nexec \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "docker"), []byte(docker), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `stubborn`\n```bash image=alpine timeout=100ms\ntrap '' TERM\nwhile true; do sleep 0.01; done\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := cmd.WithOptions(context.Background(), &cmd.Options{Stdout: io.Discard, Stderr: io.Discard, GracePeriod: 100 * time.Millisecond})
+	assert.Equal(t, cmd.ExitTimeout, cmd.RunCommands(ctx, cmds...))
+	b, _ := os.ReadFile(killed)
+	assert.Regexp(t, `^cmd-[0-9a-f]{16}\n$`, string(b))
+}
+
+func TestRetry(t *testing.T) {
+	dir := t.TempDir()
+	cmds, err := cmd.ParseCommandsFile("README.md", []byte("#### `flaky`\n```bash retry=3 retry-delay=10ms retry-backoff=exponential\necho x >> \"$COUNT\"\n[ $(wc -l < \"$COUNT\") -ge 3 ]\n```\n\n#### `picky`\n```bash retry=3 retry-delay=10ms retry-on=75\necho x >> \"$COUNT\"\nexit 2\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, cmd.RetryPolicy{Retries: 3, Delay: 10 * time.Millisecond, Backoff: cmd.BackoffExponential}, cmds[0].Retry)
+	assert.Equal(t, []int{75}, cmds[1].Retry.On)
+
+	var stdout, stderr bytes.Buffer
+	ctx := cmd.WithOptions(context.Background(), &cmd.Options{Stdout: &stdout, Stderr: &stderr})
+
+	os.Setenv("COUNT", dir+"/flaky")
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds[0]))
+	assert.Equal(t, "flaky failed with exit status 1, retrying in 10ms (1 of 3)\nflaky failed with exit status 1, retrying in 20ms (2 of 3)\n", stderr.String())
+
+	// Only the exit statuses given in retry-on are retried.
+	os.Setenv("COUNT", dir+"/picky")
+	assert.Equal(t, subcommands.ExitStatus(2), cmd.RunCommands(ctx, cmds[1]))
+	count, _ := os.ReadFile(dir + "/picky")
+	assert.Equal(t, "x\n", string(count))
+
+	// Commands killed by an interrupt aren't retried.
+	interrupted, err := cmd.ParseCommandsFile("README.md", []byte("#### `interrupted`\n```bash retry=3 retry-delay=10ms\necho x >> \"$COUNT\"\nkill -INT $$\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("COUNT", dir+"/interrupted")
+	assert.Equal(t, subcommands.ExitStatus(130), cmd.RunCommands(ctx, interrupted[0]))
+	count, _ = os.ReadFile(dir + "/interrupted")
+	assert.Equal(t, "x\n", string(count))
+
+	_, err = cmd.ParseCommandsFile("README.md", []byte("#### `bad`\n```bash retry-backoff=random\ntrue\n```\n"))
+	assert.Error(t, err)
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "docs", "web"), 0o755))
+	cmds, err := cmd.ParseCommandsFile(filepath.Join(dir, "docs", "README.md"), []byte("#### `web`\n```bash dir=web\npwd\n```\n\n#### `root`\n```bash dir=@root\npwd\n```\n\n#### `missing`\n```bash dir=missing\npwd\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "web", cmds[0].Dir)
+
+	var stdout, stderr bytes.Buffer
+	ctx := cmd.WithOptions(context.Background(), &cmd.Options{Jobs: 1, Root: dir, Stdout: &stdout, Stderr: &stderr})
+	assert.Equal(t, subcommands.ExitSuccess, cmd.RunCommands(ctx, cmds[0], cmds[1]))
+	assert.Equal(t, filepath.Join(dir, "docs", "web")+"\n"+dir+"\n", stdout.String())
+
+	assert.Equal(t, subcommands.ExitUsageError, cmd.RunCommands(ctx, cmds[2]))
+	assert.Contains(t, stderr.String(), `invalid dir "missing"`)
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	runs := filepath.Join(dir, "runs")
+	write := func(path, content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	countRuns := func(line string) int {
+		b, _ := os.ReadFile(runs)
+		return strings.Count(string(b), line+"\n")
+	}
+	write(src, "0")
+
+	cmds, err := cmd.ParseCommandsFile(filepath.Join(dir, "README.md"), []byte("#### `build`\n```bash sources=src.txt dir=.\necho built >> runs\n```\n\n#### `serve`\n```bash sources=src.txt dir=.\necho started >> runs\nsleep 5\necho stopped >> runs\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watch := func(c *cmd.Command, opts *cmd.WatchOptions) (stop func() error) {
+		ctx, cancel := context.WithCancel(cmd.WithOptions(context.Background(), &cmd.Options{Stdout: io.Discard, Stderr: io.Discard}))
+		f := flag.NewFlagSet(c.Alias, flag.ContinueOnError)
+		c.SetFlags(f)
+		errs := make(chan error, 1)
+		go func() { errs <- c.Watch(ctx, f, opts, c.Alias) }()
+		return func() error {
+			cancel()
+			return <-errs
+		}
+	}
+	settled := func(check func() bool) {
+		assert.Eventually(t, check, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// A burst of changes runs the command again only once.
+	stop := watch(cmds[0], &cmd.WatchOptions{Interval: 10 * time.Millisecond, Debounce: 100 * time.Millisecond})
+	settled(func() bool { return countRuns("built") == 1 })
+	for i := 1; i <= 3; i++ {
+		write(src, strings.Repeat("x", i))
+		time.Sleep(20 * time.Millisecond)
+	}
+	settled(func() bool { return countRuns("built") == 2 })
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 2, countRuns("built"))
+	assert.NoError(t, stop())
+
+	// A run still going is cancelled before running again. Zero options
+	// take the defaults.
+	stop = watch(cmds[1], &cmd.WatchOptions{})
+	settled(func() bool { return countRuns("started") == 1 })
+	write(src, "changed")
+	settled(func() bool { return countRuns("started") == 2 })
+	assert.NoError(t, stop())
+	assert.Equal(t, 0, countRuns("stopped"))
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// A Position is a location within a markdown file. Lines and columns start at
+// 1, and columns count bytes.
+type Position struct {
+	Path   string
+	Line   int
+	Column int
+}
+
+// String formats p as path:line:col, the format understood by most editors.
+func (p Position) String() string {
+	if p.Path == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Path, p.Line, p.Column)
+}
+
+// positionAt returns the position of the given offset into source.
+func positionAt(path string, source []byte, offset int) Position {
+	if offset > len(source) {
+		offset = len(source)
+	}
+	lineStart := bytes.LastIndexByte(source[:offset], '\n') + 1
+	return Position{
+		Path:   path,
+		Line:   bytes.Count(source[:offset], []byte("\n")) + 1,
+		Column: offset - lineStart + 1,
+	}
+}
+
+// A PositionError is an error at a given position within a markdown file.
+type PositionError struct {
+	Pos Position
+	Err error
+}
+
+func (e *PositionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Err)
+}
+
+func (e *PositionError) Unwrap() error {
+	return e.Err
+}
+
+// checkLinePatterns find the line, and maybe the column, of the first error
+// in the output of checking a code block, for the checkers used by the
+// languages built in. They are tried in order.
+var checkLinePatterns = []*regexp.Regexp{
+	// python's ast.parse
+	regexp.MustCompile(`File "<unknown>", line (\d+)`),
+	// ruby and lua on stdin, node's vm.Script, and compilers given main.*
+	regexp.MustCompile(`(?m)(?:^|[\s(])(?:-|stdin|evalmachine\.<anonymous>|(?:\./)?main\.\w+):(\d+)(?::(\d+))?`),
+	// bash -n and perl -c
+	regexp.MustCompile(`\bline (\d+)\b`),
+}
+
+// checkPosition returns the position within the markdown file of the first
+// error in out, the output of checking c, if it tells the line.
+func (c *Command) checkPosition(out string) (Position, bool) {
+	for _, p := range checkLinePatterns {
+		m := p.FindStringSubmatch(out)
+		if m == nil {
+			continue
+		}
+
+		line, _ := strconv.Atoi(m[1])
+		pos := Position{Path: c.InputPath, Line: c.CodePos.Line + line - 1, Column: c.CodePos.Column}
+		if len(m) > 2 && m[2] != "" {
+			column, _ := strconv.Atoi(m[2])
+			pos.Column += column - 1
+		}
+		return pos, true
+	}
+	return Position{}, false
+}
+
+// positionError attaches the most precise position known to err: that of a
+// syntax error within the code block, or else that of the code block itself.
+func (d *CommandDefinition) positionError(err error) error {
+	var posErr *PositionError
+	if errors.As(err, &posErr) {
+		return err
+	}
+
+	var parseErr syntax.ParseError
+	if errors.As(err, &parseErr) && parseErr.Pos.IsValid() {
+		return &PositionError{
+			Pos: Position{
+				Path:   d.InputPath,
+				Line:   d.CodePos.Line + int(parseErr.Pos.Line()) - 1,
+				Column: d.CodePos.Column + int(parseErr.Pos.Col()) - 1,
+			},
+			Err: errors.New(parseErr.Text),
+		}
+	}
+
+	return &PositionError{Pos: d.DeclarationPos, Err: err}
+}
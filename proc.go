@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+// ExitTimeout is the exit status when a command is stopped for running
+// longer than its timeout, as with timeout(1).
+const ExitTimeout subcommands.ExitStatus = 124
+
+// defaultGracePeriod is how long commands get to exit once interrupted,
+// unless Options.GracePeriod says otherwise.
+const defaultGracePeriod = 10 * time.Second
+
+func (opts *Options) gracePeriod() time.Duration {
+	if opts.GracePeriod > 0 {
+		return opts.GracePeriod
+	}
+	return defaultGracePeriod
+}
+
+// timeout returns how long c may run, if limited: its timeout field, or else
+// Options.Timeout.
+func (c *Command) timeout(ctx context.Context) time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return optionsFrom(ctx).Timeout
+}
+
+// detachedContext carries the values of a context, but is never done. As
+// exec.CommandContext kills a command outright once its context is done,
+// commands are created with one, leaving it to run to stop them gracefully.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+func isTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// runTimeout runs cmd for c with stdio, stopping it after c's timeout. Like
+// run, it also reports whether cmd was interrupted, which running out of time
+// doesn't count as.
+func (c *Command) runTimeout(ctx context.Context, cmd *exec.Cmd, stdio stdio) (subcommands.ExitStatus, bool) {
+	timeout := c.timeout(ctx)
+	if timeout <= 0 {
+		return run(ctx, cmd, stdio)
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	status, interrupted := run(runCtx, cmd, stdio)
+	if runCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		fmt.Fprintf(stdio.err, "fatal: %s timed out after %s\n", c.Alias, timeout)
+		return ExitTimeout, false
+	}
+	return status, interrupted
+}
+
+// run runs cmd with stdio, returning its exit status, and whether it was
+// interrupted: SIGINT or SIGTERM was forwarded to it, or killed it, as when
+// Ctrl-C reaches it directly while it has the terminal. It runs in a process
+// group of its own, which SIGINT and SIGTERM are forwarded to. Once ctx is
+// done, the group is sent SIGTERM. Either way, it is killed if it hasn't
+// exited after the grace period, or on a second signal.
+func run(ctx context.Context, cmd *exec.Cmd, stdio stdio) (subcommands.ExitStatus, bool) {
+	cmd.Stderr = stdio.err
+	cmd.Stdout = stdio.out
+	cmd.Stdin = stdio.in
+
+	restoreTerminal := setProcessGroup(cmd, stdio.in)
+	defer restoreTerminal()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(stdio.err, "err: %s", err)
+		return subcommands.ExitFailure, false
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	interrupted, forwarded := false, false
+	var kill <-chan time.Time
+	interrupt := func(sig os.Signal) {
+		if interrupted {
+			killProcess(cmd)
+			return
+		}
+		interrupted = true
+		signalProcess(cmd, sig)
+		kill = time.After(optionsFrom(ctx).gracePeriod())
+	}
+
+	ctxDone := ctx.Done()
+	for {
+		select {
+		case err := <-done:
+			if err == nil {
+				return subcommands.ExitSuccess, forwarded
+			}
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				return exitStatus(exitErr), forwarded || interruptedBy(exitErr)
+			}
+			fmt.Fprintf(stdio.err, "err: %s", err)
+			return subcommands.ExitFailure, forwarded
+
+		case sig := <-signals:
+			forwarded = true
+			interrupt(sig)
+
+		case <-ctxDone:
+			ctxDone = nil
+			// When interrupted, the context is cancelled too, and the
+			// signal is either handled already or waiting.
+			if interrupted {
+				continue
+			}
+			select {
+			case sig := <-signals:
+				forwarded = true
+				interrupt(sig)
+			default:
+				interrupt(syscall.SIGTERM)
+			}
+
+		case <-kill:
+			kill = nil
+			killProcess(cmd)
+		}
+	}
+}
+
+// killProcess kills cmd's process group, and the container it runs in, if
+// any, as killing the docker client alone leaves it running.
+func killProcess(cmd *exec.Cmd) {
+	signalProcess(cmd, os.Kill)
+	if name := containerNameOf(cmd); name != "" {
+		exec.Command(cmd.Path, "kill", name).Run()
+	}
+}
+
+// containerName returns a new name for a container to run a command in, so
+// that it can be killed by name.
+func containerName() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "cmd-" + hex.EncodeToString(b)
+}
+
+var containerNamePattern = regexp.MustCompile(`^cmd-[0-9a-f]{16}$`)
+
+// containerNameOf returns the name of the container cmd runs in, if it was
+// given one by containerName.
+func containerNameOf(cmd *exec.Cmd) string {
+	if len(cmd.Args) < 2 || cmd.Args[0] != "docker" || cmd.Args[1] != "run" {
+		return ""
+	}
+	for i := 0; i+1 < len(cmd.Args); i++ {
+		if cmd.Args[i] == "--name" && containerNamePattern.MatchString(cmd.Args[i+1]) {
+			return cmd.Args[i+1]
+		}
+	}
+	return ""
+}
+
+// stableArgs returns cmd's arguments without the name of the container it
+// runs in, which differs on every run, for hashing what it runs.
+func stableArgs(cmd *exec.Cmd) []string {
+	args := make([]string, 0, len(cmd.Args))
+	for i := 0; i < len(cmd.Args); i++ {
+		if cmd.Args[i] == "--name" && i+1 < len(cmd.Args) && containerNamePattern.MatchString(cmd.Args[i+1]) {
+			i++
+			continue
+		}
+		args = append(args, cmd.Args[i])
+	}
+	return args
+}
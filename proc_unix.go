@@ -0,0 +1,88 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"unsafe"
+
+	"github.com/google/subcommands"
+)
+
+// setProcessGroup makes cmd run in a process group of its own, so that it can
+// be stopped along with the processes it starts. When it reads from the
+// terminal this process is in the foreground of, the terminal's foreground is
+// handed to the group too, so that it still gets Ctrl-C and may read from the
+// terminal. The returned function takes it back once cmd has exited.
+func setProcessGroup(cmd *exec.Cmd, stdin io.Reader) func() {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	f, ok := stdin.(*os.File)
+	if !ok || !isTerminal(f) {
+		return func() {}
+	}
+	fd := int(f.Fd())
+	if pgrp, err := tcgetpgrp(fd); err != nil || pgrp != syscall.Getpgrp() {
+		return func() {}
+	}
+
+	cmd.SysProcAttr.Foreground = true
+	cmd.SysProcAttr.Ctty = fd
+	return func() {
+		// Processes outside the foreground are stopped by SIGTTOU when
+		// changing it, unless they ignore it.
+		signal.Ignore(syscall.SIGTTOU)
+		defer signal.Reset(syscall.SIGTTOU)
+		tcsetpgrp(fd, syscall.Getpgrp())
+	}
+}
+
+func tcgetpgrp(fd int) (int, error) {
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(pgrp), nil
+}
+
+func tcsetpgrp(fd, pgrp int) error {
+	p := int32(pgrp)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCSPGRP), uintptr(unsafe.Pointer(&p)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// signalProcess sends sig to cmd's process group.
+func signalProcess(cmd *exec.Cmd, sig os.Signal) {
+	s, ok := sig.(syscall.Signal)
+	if !ok || cmd.Process == nil {
+		return
+	}
+	syscall.Kill(-cmd.Process.Pid, s)
+}
+
+// exitStatus returns the exit status of a command, which for one killed by a
+// signal is 128 plus the signal's number, as shells report it.
+func exitStatus(err *exec.ExitError) subcommands.ExitStatus {
+	if status, ok := err.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return subcommands.ExitStatus(128 + int(status.Signal()))
+	}
+	return subcommands.ExitStatus(err.ExitCode())
+}
+
+// interruptedBy reports whether a command was killed by SIGINT or SIGTERM.
+func interruptedBy(err *exec.ExitError) bool {
+	status, ok := err.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && (status.Signal() == syscall.SIGINT || status.Signal() == syscall.SIGTERM)
+}
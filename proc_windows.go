@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/google/subcommands"
+)
+
+func setProcessGroup(cmd *exec.Cmd, stdin io.Reader) func() {
+	return func() {}
+}
+
+// signalProcess stops cmd, as signals other than os.Kill can't be sent on
+// Windows.
+func signalProcess(cmd *exec.Cmd, sig os.Signal) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+func exitStatus(err *exec.ExitError) subcommands.ExitStatus {
+	return subcommands.ExitStatus(err.ExitCode())
+}
+
+func interruptedBy(err *exec.ExitError) bool {
+	return false
+}
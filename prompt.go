@@ -0,0 +1,15 @@
+package cmd
+
+import (
+	"regexp"
+)
+
+// secretName matches the names of variables that look like they hold
+// secrets, whose values shouldn't be shown.
+var secretName = regexp.MustCompile(`(?i)secret|token|passw(or)?d|pass$|_pw$|key|credential|auth|private|cookie|session`)
+
+// IsSecretName reports whether name looks like that of a variable holding a
+// secret, whose value shouldn't be shown.
+func IsSecretName(name string) bool {
+	return secretName.MatchString(name)
+}
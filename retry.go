@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+// Ways the delay between retries grows.
+const (
+	BackoffConstant    = "constant"
+	BackoffLinear      = "linear"
+	BackoffExponential = "exponential"
+)
+
+// A RetryPolicy tells whether and when to run a command again after it fails,
+// as given in the info string:
+//
+//	```bash retry=3 retry-delay=2s retry-backoff=exponential retry-on=1,75
+//
+// Retries is how many times to run it again at most, and Delay how long to
+// wait before the first retry, 1s by default. With linear backoff the delay
+// grows by Delay every time, and with exponential backoff it doubles. Only
+// failures with the exit statuses in On are retried, or all if empty.
+type RetryPolicy struct {
+	Retries int
+	Delay   time.Duration
+	Backoff string
+	On      []int
+}
+
+func parseRetryPolicy(fields map[string]string) (RetryPolicy, error) {
+	p := RetryPolicy{Delay: time.Second, Backoff: BackoffConstant}
+	if value := fields["retry"]; value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("invalid retry: %q", value)
+		}
+		p.Retries = n
+	}
+
+	if value := fields["retry-delay"]; value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return p, fmt.Errorf("invalid retry-delay: %q", value)
+		}
+		p.Delay = d
+	}
+
+	if value := fields["retry-backoff"]; value != "" {
+		switch value {
+		case BackoffConstant, BackoffLinear, BackoffExponential:
+			p.Backoff = value
+		default:
+			return p, fmt.Errorf("invalid retry-backoff: %q, must be one of %s, %s, %s", value, BackoffConstant, BackoffLinear, BackoffExponential)
+		}
+	}
+
+	for _, value := range splitList(fields["retry-on"]) {
+		status, err := strconv.Atoi(value)
+		if err != nil || status == 0 {
+			return p, fmt.Errorf("invalid exit status in retry-on: %q", value)
+		}
+		p.On = append(p.On, status)
+	}
+
+	return p, nil
+}
+
+// retries reports whether a run ending with status should be retried.
+func (p *RetryPolicy) retries(status subcommands.ExitStatus) bool {
+	if status == subcommands.ExitSuccess || status == ExitNotConfirmed {
+		return false
+	}
+	if len(p.On) == 0 {
+		return true
+	}
+	for _, s := range p.On {
+		if subcommands.ExitStatus(s) == status {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait before the given retry, counting from 1.
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	switch p.Backoff {
+	case BackoffLinear:
+		return p.Delay * time.Duration(retry)
+	case BackoffExponential:
+		return p.Delay << uint(retry-1)
+	}
+	return p.Delay
+}
+
+// runRetrying runs cmd for c with stdio, and again while it fails as long as
+// c's RetryPolicy allows, unless it was interrupted. It returns the command
+// run last and its status.
+func (c *Command) runRetrying(ctx context.Context, cmd *exec.Cmd, stdio stdio) (*exec.Cmd, subcommands.ExitStatus) {
+	status, interrupted := c.runTimeout(ctx, cmd, stdio)
+	for retry := 1; retry <= c.Retry.Retries && c.Retry.retries(status); retry++ {
+		if interrupted || ctx.Err() != nil {
+			break
+		}
+
+		delay := c.Retry.delay(retry)
+		fmt.Fprintf(stdio.err, "%s failed with exit status %d, retrying in %s (%d of %d)\n", c.Alias, status, delay, retry, c.Retry.Retries)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return cmd, status
+		}
+
+		// A command only runs once, so run a copy of it.
+		cmd = cloneCmd(cmd)
+		status, interrupted = c.runTimeout(ctx, cmd, stdio)
+	}
+	return cmd, status
+}
+
+// cloneCmd returns a copy of cmd that hasn't been started.
+func cloneCmd(cmd *exec.Cmd) *exec.Cmd {
+	return &exec.Cmd{
+		Path: cmd.Path,
+		Args: cmd.Args,
+		Env:  cmd.Env,
+		Dir:  cmd.Dir,
+	}
+}
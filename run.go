@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+// Options configure how commands run. As subcommands only passes a context
+// on to Execute, they are attached to it with WithOptions.
+type Options struct {
+	// Jobs limits how many commands run at once. Zero means one at a time.
+	Jobs int
+
+	// Force runs commands even if they are up to date.
+	Force bool
+
+	// DryRun prints what commands would run instead of running them.
+	DryRun bool
+
+	// EnvFiles are .env files to read besides the .env file next to the
+	// markdown file, and Profile selects the .env.<profile> file read after
+	// it. The process environment takes precedence over all of them.
+	EnvFiles []string
+	Profile  string
+
+	// LogDir, if set, is the directory the output of each command is logged
+	// to, besides being shown, unless its log field says otherwise. Commands
+	// whose output is logged don't write to a terminal, even when shown on
+	// one.
+	LogDir string
+
+	// Root is the project's root directory, which dir=@root refers to, such
+	// as the one the markdown file was found in for .../NAME. It defaults to
+	// the directory of the file each command is defined in.
+	Root string
+
+	// HistoryFile, if set, is the file each run of a command is recorded in,
+	// as a line of JSON.
+	HistoryFile string
+
+	// Timeout limits how long each command may run, unless its timeout
+	// field says otherwise.
+	Timeout time.Duration
+
+	// GracePeriod is how long commands get to exit once interrupted, before
+	// they're killed. Zero means 10 seconds.
+	GracePeriod time.Duration
+
+	// Yes runs commands needing confirmation without asking.
+	Yes bool
+
+	// Confirm, if set, shows the warning for a command needing confirmation
+	// and asks whether to run it. Without it, such commands are refused
+	// unless Yes is set.
+	Confirm func(alias, warning string) (bool, error)
+
+	// Prompt, if set, asks for the values of required variables and params
+	// that weren't given. Instead of failing, commands then run with the
+	// answers. Secret is set for names that look like they hold secrets,
+	// whose answers shouldn't be echoed.
+	Prompt func(name string, secret bool) (string, error)
+
+	// Stdin, Stdout and Stderr default to those of the process.
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+}
+
+type optionsKey struct{}
+
+// WithOptions returns a copy of ctx that runs commands with opts.
+func WithOptions(ctx context.Context, opts *Options) context.Context {
+	return context.WithValue(ctx, optionsKey{}, opts)
+}
+
+func optionsFrom(ctx context.Context) *Options {
+	if opts, ok := ctx.Value(optionsKey{}).(*Options); ok && opts != nil {
+		return opts
+	}
+	return &Options{}
+}
+
+// IsDryRun reports whether commands run with ctx are only described. Languages
+// then render them without side effects, such as building or writing files.
+func IsDryRun(ctx context.Context) bool {
+	return optionsFrom(ctx).DryRun
+}
+
+func (opts *Options) jobs() int {
+	if opts.Jobs > 0 {
+		return opts.Jobs
+	}
+	return 1
+}
+
+// stdio is where a command reads its input and writes its output.
+type stdio struct {
+	in       io.Reader
+	out, err io.Writer
+}
+
+func (opts *Options) stdio() stdio {
+	s := stdio{in: opts.Stdin, out: opts.Stdout, err: opts.Stderr}
+	if s.in == nil {
+		s.in = os.Stdin
+	}
+	if s.out == nil {
+		s.out = os.Stdout
+	}
+	if s.err == nil {
+		s.err = os.Stderr
+	}
+	return s
+}
+
+// RunCommands runs cmds along with the commands they need, each with the
+// defaults for all its flags. It stops at the first one that fails, returning
+// its status.
+func RunCommands(ctx context.Context, cmds ...*Command) subcommands.ExitStatus {
+	return runPlan(ctx, planFor(cmds), "")
+}
+
+// runPlan runs the commands in plan, each once all the commands it needs have
+// succeeded. Up to Options.Jobs of them run at once, in which case each line
+// they output is prefixed with their alias. Once one fails, no more are
+// started, and the status of the first to fail is returned. Those that need
+// confirmation are all confirmed before any runs.
+func runPlan(ctx context.Context, plan []*Command, neededBy string) subcommands.ExitStatus {
+	opts := optionsFrom(ctx)
+	std := opts.stdio()
+	jobs := opts.jobs()
+
+	if !opts.DryRun {
+		var err error
+		ctx, err = confirmPlan(ctx, plan)
+		if err != nil {
+			fmt.Fprintf(std.err, "fatal: %s\n", err)
+			return ExitNotConfirmed
+		}
+	}
+
+	fail := func(c *Command, status subcommands.ExitStatus) {
+		if neededBy != "" {
+			fmt.Fprintf(std.err, "fatal: %s needed by %s failed with exit status %d\n", c.Alias, neededBy, status)
+		} else {
+			fmt.Fprintf(std.err, "fatal: %s failed with exit status %d\n", c.Alias, status)
+		}
+	}
+
+	if jobs == 1 || len(plan) < 2 {
+		for _, c := range plan {
+			if status := c.executeDefaults(ctx, std); status != subcommands.ExitSuccess {
+				fail(c, status)
+				return status
+			}
+		}
+		return subcommands.ExitSuccess
+	}
+
+	width := 0
+	for _, c := range plan {
+		if len(c.Alias) > width {
+			width = len(c.Alias)
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		outputMu sync.Mutex
+		failed   subcommands.ExitStatus
+	)
+	slots := make(chan struct{}, jobs)
+	done := map[*Command]chan struct{}{}
+	for _, c := range plan {
+		done[c] = make(chan struct{})
+	}
+
+	for _, c := range plan {
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[c])
+
+			for _, dep := range c.Dependencies {
+				<-done[dep]
+			}
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			mu.Lock()
+			stop := failed != subcommands.ExitSuccess
+			mu.Unlock()
+			if stop {
+				return
+			}
+
+			prefix := fmt.Sprintf("%-*s | ", width, c.Alias)
+			out := &prefixWriter{mu: &outputMu, w: std.out, prefix: prefix}
+			errOut := &prefixWriter{mu: &outputMu, w: std.err, prefix: prefix}
+			// Commands running side by side can't share stdin.
+			status := c.executeDefaults(ctx, stdio{in: nil, out: out, err: errOut})
+			out.Flush()
+			errOut.Flush()
+
+			if status != subcommands.ExitSuccess {
+				mu.Lock()
+				if failed == subcommands.ExitSuccess {
+					failed = status
+				}
+				mu.Unlock()
+
+				outputMu.Lock()
+				fail(c, status)
+				outputMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return failed
+}
+
+// A prefixWriter writes each line to w preceded by prefix. Partial lines are
+// held back until complete or flushed, and writes are serialized by mu, so
+// that prefixWriters sharing it never interleave their lines.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+	i := bytes.LastIndexByte(pw.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+
+	if err := pw.write(pw.buf[:i+1]); err != nil {
+		return 0, err
+	}
+	pw.buf = append(pw.buf[:0], pw.buf[i+1:]...)
+	return len(p), nil
+}
+
+// Flush writes out any partial line, ending it with a newline.
+func (pw *prefixWriter) Flush() error {
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	err := pw.write(append(pw.buf, '\n'))
+	pw.buf = pw.buf[:0]
+	return err
+}
+
+func (pw *prefixWriter) write(lines []byte) error {
+	var b bytes.Buffer
+	for len(lines) > 0 {
+		i := bytes.IndexByte(lines, '\n')
+		b.WriteString(pw.prefix)
+		b.Write(lines[:i+1])
+		lines = lines[i+1:]
+	}
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	_, err := pw.w.Write(b.Bytes())
+	return err
+}
@@ -2,8 +2,13 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/exec"
+	"reflect"
+	"sort"
 	"strings"
 
 	"mvdan.cc/sh/v3/syntax"
@@ -46,32 +51,114 @@ func (c *ShellCommand) Render(locals map[string]*ShellValue) (string, error) {
 			return "", fmt.Errorf("unknown local: %q", name)
 		}
 
-		if value.Expression != "" {
-			return "", fmt.Errorf("local with expression values are not yet supported. local: %q", name)
+		word, err := value.Word()
+		if err != nil {
+			return "", fmt.Errorf("invalid value for local %q: %w", name, err)
 		}
 
+		// The word comes without positions of its own. Place it where the
+		// expansion is, or the printer takes it to be on another line.
+		syntax.Walk(word, func(n syntax.Node) bool {
+			setPositions(n, node.Pos())
+			return true
+		})
+
+		// $NAME has to become ${NAME:=value} for the value to be printed.
+		if node.Short {
+			node.Short = false
+			node.Rbrace = node.Pos()
+		}
 		node.Exp = &syntax.Expansion{
-			Op: syntax.AssignUnsetOrNull,
-			Word: &syntax.Word{
-				Parts: []syntax.WordPart{
-					&syntax.Lit{
-						ValuePos: syntax.NewPos(0, 0, 0),
-						ValueEnd: syntax.NewPos(0, 0, 0),
-						Value:    value.Literal,
-					},
-				},
-			},
+			Op:   syntax.AssignUnsetOrNull,
+			Word: word,
 		}
 	}
 
 	return c2.Print()
 }
 
+// parseShellWord parses s as exactly one shell word, keeping any expansions
+// (command substitutions, parameter expansions, ...) it contains intact.
+func parseShellWord(s string) (*syntax.Word, error) {
+	var words []*syntax.Word
+	err := syntax.NewParser().Words(strings.NewReader(s), func(w *syntax.Word) bool {
+		words = append(words, w)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(words) != 1 {
+		return nil, fmt.Errorf("expected a single word, found %d in %q", len(words), s)
+	}
+
+	// The word was parsed on its own, so its positions are meaningless in
+	// the file it will be spliced into. Reset them so the printer doesn't
+	// try to honor them.
+	syntax.Walk(words[0], func(n syntax.Node) bool {
+		setPositions(n, syntax.Pos{})
+		return true
+	})
+
+	return words[0], nil
+}
+
 type ShellValue struct {
 	Literal    string
 	Expression string
 }
 
+var posType = reflect.TypeOf(syntax.Pos{})
+
+// setPositions sets every position field of the given node to pos.
+func setPositions(n syntax.Node, pos syntax.Pos) {
+	v := reflect.ValueOf(n)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return
+	}
+
+	v = v.Elem()
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		if field := v.Field(i); field.Type() == posType && field.CanSet() {
+			field.Set(reflect.ValueOf(pos))
+		}
+	}
+}
+
+// Word returns the syntax tree for v. Literals become a single literal part,
+// while expressions are parsed so that the resulting tree can be spliced into
+// another file and evaluated there.
+func (v *ShellValue) Word() (*syntax.Word, error) {
+	if v.Expression == "" {
+		return &syntax.Word{
+			Parts: []syntax.WordPart{
+				&syntax.Lit{
+					ValuePos: syntax.NewPos(0, 0, 0),
+					ValueEnd: syntax.NewPos(0, 0, 0),
+					Value:    v.Literal,
+				},
+			},
+		}, nil
+	}
+
+	return parseShellWord(v.Expression)
+}
+
+// sortedNames returns the names of the variables in vars, sorted.
+func sortedNames(vars map[string]*ShellValue) []string {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func asShellValue(w *syntax.Word) (*ShellValue, error) {
 	if w == nil {
 		return nil, nil
@@ -209,3 +296,106 @@ func NewShellCommand(shell string) (*ShellCommand, error) {
 		File:              f,
 	}, nil
 }
+
+type shellLanguage struct {
+	command *ShellCommand
+	text    string
+	program string
+}
+
+func newShellLanguage(name, text string) (Language, error) {
+	shellCommand, err := NewShellCommand(text)
+	if err != nil {
+		return nil, err
+	}
+
+	program := name
+	if name == "shell" {
+		program = os.Getenv("SHELL")
+	}
+
+	return &shellLanguage{
+		command: shellCommand,
+		text:    text,
+		program: program,
+	}, nil
+}
+
+func (l *shellLanguage) SetExecFlags(f *flag.FlagSet) {
+	for name, defaultValue := range l.command.Locals {
+		var v string
+		if defaultValue == nil {
+			f.StringVar(&v, name, os.Getenv(name), fmt.Sprintf("falls back to $%s", name))
+		} else {
+			if defaultValue.Literal != "" {
+				f.StringVar(&v, name, defaultValue.Literal, fmt.Sprintf("falls back to $%s", name))
+			} else {
+				f.StringVar(&v, name, "", fmt.Sprintf("falls back to $%s (default is expression %s)", name, defaultValue.Expression))
+			}
+		}
+	}
+}
+
+// From the bash manual page:
+// If the -c option is present, then commands are read from string.  If there are arguments after the string, they are assigned to the positional parameters, starting with $0.
+func (l *shellLanguage) RenderExecCmd(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error) {
+	var env []string
+	for _, name := range sortedNames(l.command.Exports) {
+		if l.command.Exports[name] == nil && os.Getenv(name) == "" {
+			value, err := missingValue(ctx, name, fmt.Errorf("environment variable not set: %s", name))
+			if err != nil {
+				return nil, err
+			}
+			env = append(env, name, value)
+		}
+	}
+
+	locals := map[string]*ShellValue{}
+
+	for _, name := range sortedNames(l.command.Locals) {
+		defaultValue := l.command.Locals[name]
+		var v string
+		flag := f.Lookup(name)
+		set := false
+
+		if flag != nil {
+			v = flag.Value.String()
+			set = v != ""
+		}
+
+		if !set && defaultValue == nil {
+			// Pass the value through the environment rather than the
+			// script, as it may be a secret.
+			value, err := missingValue(ctx, name, fmt.Errorf("option not given: %s", name))
+			if err != nil {
+				return nil, err
+			}
+			env = append(env, name, value)
+			continue
+		}
+
+		if set {
+			locals[name] = &ShellValue{Literal: v}
+		}
+	}
+
+	rendered, err := l.command.Render(locals)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx,
+		l.program,
+		append(
+			[]string{"-c", rendered, fmt.Sprint(args[0])},
+			f.Args()...,
+		)...,
+	)
+	for i := 0; i < len(env); i += 2 {
+		setEnv(cmd, env[i], env[i+1])
+	}
+	return cmd, nil
+}
+
+func (l *shellLanguage) RenderCheckCmd(ctx context.Context) (*exec.Cmd, error) {
+	return exec.CommandContext(ctx, l.program, "-n", "-c", l.text), nil
+}
@@ -90,6 +90,49 @@ foo() {
 				},
 			},
 		},
+		{
+			name: "expression locals",
+			source: `
+: ${OUT:=$(git rev-parse --show-toplevel)/build}
+: ${TAG}
+echo $OUT $TAG
+`,
+			command: &cmd.ShellCommand{
+				Exports: map[string]*cmd.ShellValue{},
+				Locals:  map[string]*cmd.ShellValue{"OUT": expr("$(git rev-parse --show-toplevel)/build"), "TAG": nil},
+			},
+			scenarios: []scenario{
+				{
+					s: `: ${OUT:=$(git rev-parse --show-toplevel)/build}
+: ${TAG}
+echo $OUT $TAG
+`,
+					locals: map[string]*cmd.ShellValue{},
+				},
+				{
+					s: `: ${OUT:=/tmp/out}
+: ${TAG:=$(date +%s)-"$USER"}
+echo $OUT $TAG
+`,
+					locals: map[string]*cmd.ShellValue{
+						"OUT": lit("/tmp/out"),
+						"TAG": expr(`$(date +%s)-"$USER"`),
+					},
+				},
+				{
+					s: `: ${OUT:=$(
+	cd /
+	pwd
+)/build}
+: ${TAG}
+echo $OUT $TAG
+`,
+					locals: map[string]*cmd.ShellValue{
+						"OUT": expr("$(cd /\npwd)/build"),
+					},
+				},
+			},
+		},
 		{
 			name: "discover locals",
 			source: `
@@ -100,6 +143,25 @@ foo() {
 				Locals:  map[string]*cmd.ShellValue{"S": nil, "Y": lit("1"), "Z": lit("2")},
 			},
 		},
+		{
+			name: "short locals",
+			source: `
+echo $NAME
+`,
+			command: &cmd.ShellCommand{
+				Exports: map[string]*cmd.ShellValue{},
+				Locals:  map[string]*cmd.ShellValue{"NAME": nil},
+			},
+			scenarios: []scenario{
+				{
+					s: `echo ${NAME:=x}
+`,
+					locals: map[string]*cmd.ShellValue{
+						"NAME": lit("x"),
+					},
+				},
+			},
+		},
 		{
 			name: "discover exports",
 			source: `
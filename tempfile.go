@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// TempfileLanguage describes a language whose code blocks are run by writing
+// them to a file and handing that file to an interpreter.
+type TempfileLanguage struct {
+	// Extension is given to the file the code block is written to, e.g. ".rb".
+	Extension string
+
+	// Interpreter is the program, and any leading arguments, used to run the
+	// file. The file's path and the command's arguments are appended to it.
+	Interpreter []string
+
+	// Check is the program, and any arguments, used to check the code block
+	// for syntax errors. The code block is given on stdin. Languages without
+	// a way to do so leave it empty.
+	Check []string
+}
+
+func init() {
+	RegisterTempfileLanguage("ruby", &TempfileLanguage{
+		Extension:   ".rb",
+		Interpreter: []string{"ruby"},
+		Check:       []string{"ruby", "-c"},
+	})
+	RegisterTempfileLanguage("perl", &TempfileLanguage{
+		Extension:   ".pl",
+		Interpreter: []string{"perl"},
+		Check:       []string{"perl", "-c"},
+	})
+	RegisterTempfileLanguage("deno", &TempfileLanguage{
+		Extension:   ".ts",
+		Interpreter: []string{"deno", "run", "--allow-all"},
+	})
+	for _, name := range []string{"pwsh", "powershell"} {
+		RegisterTempfileLanguage(name, &TempfileLanguage{
+			Extension:   ".ps1",
+			Interpreter: []string{"pwsh", "-NoLogo", "-NoProfile", "-File"},
+		})
+	}
+	RegisterTempfileLanguage("lua", &TempfileLanguage{
+		Extension:   ".lua",
+		Interpreter: []string{"lua"},
+		Check:       []string{"luac", "-p", "-"},
+	})
+	RegisterTempfileLanguage("awk", &TempfileLanguage{
+		Extension:   ".awk",
+		Interpreter: []string{"awk", "-f"},
+	})
+}
+
+// RegisterTempfileLanguage makes code blocks in the named language runnable
+// with l, replacing any previous registration for the name. Like
+// RegisterLanguage, it is meant to be called from an init function, and it
+// panics if l has no Interpreter.
+func RegisterTempfileLanguage(name string, l *TempfileLanguage) {
+	if len(l.Interpreter) == 0 {
+		panic(fmt.Sprintf("cmd: no interpreter given for language %s", name))
+	}
+	RegisterLanguage(name, l.New)
+}
+
+// New returns the Language for a code block written in l.
+func (l *TempfileLanguage) New(name, text string) (Language, error) {
+	return &tempfileBlock{language: l, text: text}, nil
+}
+
+type tempfileBlock struct {
+	language *TempfileLanguage
+	text     string
+}
+
+func (b *tempfileBlock) SetExecFlags(f *flag.FlagSet) {}
+
+func (b *tempfileBlock) RenderExecCmd(ctx context.Context, f *flag.FlagSet, args ...interface{}) (*exec.Cmd, error) {
+	l := b.language
+	var scriptPath string
+	var err error
+	if IsDryRun(ctx) {
+		scriptPath, err = scriptPathFor(b.text, l.Extension)
+	} else {
+		scriptPath, err = writeScript(b.text, l.Extension)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cmdArgs := append([]string{}, l.Interpreter[1:]...)
+	cmdArgs = append(cmdArgs, scriptPath)
+	cmdArgs = append(cmdArgs, f.Args()...)
+	return exec.CommandContext(ctx, l.Interpreter[0], cmdArgs...), nil
+}
+
+func (b *tempfileBlock) RenderCheckCmd(ctx context.Context) (*exec.Cmd, error) {
+	l := b.language
+	if len(l.Check) == 0 {
+		return nil, nil
+	}
+
+	cmd := exec.CommandContext(ctx, l.Check[0], l.Check[1:]...)
+	cmd.Stdin = strings.NewReader(b.text)
+	return cmd, nil
+}
+
+// DockerArgs mounts the directory the script is written to, as it is written
+// on the host but has to be visible within the container too.
+func (b *tempfileBlock) DockerArgs() ([]string, error) {
+	dir, err := cachePath("scripts")
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-v", dir + ":" + dir + ":ro"}, nil
+}
+
+// cachePath returns the path of a directory for cmd's own use within the
+// user's cache directory.
+func cachePath(elem ...string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{dir, "cmd"}, elem...)...), nil
+}
+
+// cacheDir is like cachePath, but creates the directory if needed.
+func cacheDir(elem ...string) (string, error) {
+	dir, err := cachePath(elem...)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// scriptPathFor returns the path writeScript writes text to, without writing
+// it.
+func scriptPathFor(text, extension string) (string, error) {
+	dir, err := cachePath("scripts")
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(text))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+extension), nil
+}
+
+// writeScript writes text to a file named after its hash, so that it is only
+// written once no matter how many times it is run.
+func writeScript(text, extension string) (string, error) {
+	dir, err := cacheDir("scripts")
+	if err != nil {
+		return "", err
+	}
+
+	scriptPath, err := scriptPathFor(text, extension)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(scriptPath); err == nil {
+		return scriptPath, nil
+	}
+
+	// Write to a temporary file first so a concurrent run never sees a
+	// partially written script.
+	tmp, err := ioutil.TempFile(dir, "*"+extension)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(text); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	return scriptPath, os.Rename(tmp.Name(), scriptPath)
+}
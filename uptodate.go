@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stateDir is the directory, next to the markdown file defining a command,
+// where state about past runs is kept.
+const stateDir = ".cmd"
+
+// baseDir returns the directory relative paths given for c are resolved
+// against.
+func (c *Command) baseDir() string {
+	return inputDir(c.InputPath)
+}
+
+// tracksFiles reports whether c declares the files it reads or writes.
+func (c *Command) tracksFiles() bool {
+	return len(c.Sources) > 0 || len(c.Outputs) > 0
+}
+
+// upToDate reports whether running cmd for c can be skipped. That is the case
+// when all of c's outputs exist and either none is older than its sources, or
+// the fingerprint of cmd and its sources matches the one stored by the last
+// successful run. It never is when c declares sources but none exist, as
+// they're likely misspelt or yet to be generated.
+func (c *Command) upToDate(cmd *exec.Cmd) (bool, error) {
+	sources, err := c.glob(c.Sources, false)
+	if err != nil || (len(c.Sources) > 0 && len(sources) == 0) {
+		return false, err
+	}
+	outputs, err := c.glob(c.Outputs, true)
+	if err != nil || outputs == nil {
+		return false, err
+	}
+
+	if len(c.Outputs) > 0 {
+		newest, err := modTime(sources, time.Time.After)
+		if err != nil {
+			return false, err
+		}
+		oldest, err := modTime(outputs, time.Time.Before)
+		if err != nil {
+			return false, err
+		}
+		if !oldest.Before(newest) {
+			return true, nil
+		}
+	}
+
+	if len(c.Sources) == 0 {
+		return false, nil
+	}
+
+	fingerprint, err := c.fingerprint(cmd, sources)
+	if err != nil {
+		return false, err
+	}
+	stored, err := os.ReadFile(c.fingerprintPath())
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return string(stored) == fingerprint, nil
+}
+
+// saveFingerprint stores the fingerprint of cmd and c's sources, after it ran
+// successfully.
+func (c *Command) saveFingerprint(cmd *exec.Cmd) error {
+	if len(c.Sources) == 0 {
+		return nil
+	}
+
+	sources, err := c.glob(c.Sources, false)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := c.fingerprint(cmd, sources)
+	if err != nil {
+		return err
+	}
+
+	p := c.fingerprintPath()
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, []byte(fingerprint), 0o644)
+}
+
+func (c *Command) fingerprintPath() string {
+	sum := sha256.Sum256([]byte(c.InputPath + "\x00" + c.Alias))
+	return filepath.Join(c.baseDir(), stateDir, "fingerprints", hex.EncodeToString(sum[:]))
+}
+
+// fingerprint hashes what cmd runs, with which arguments and environment, and
+// the contents of sources.
+func (c *Command) fingerprint(cmd *exec.Cmd, sources []string) (string, error) {
+	h := sha256.New()
+	for _, arg := range stableArgs(cmd) {
+		fmt.Fprintf(h, "arg %q\n", arg)
+	}
+	for _, name := range changedEnv(cmd) {
+		fmt.Fprintf(h, "env %q\n", name+"="+lookupEnv(cmd, name))
+	}
+	fmt.Fprintf(h, "dir %q\n", cmd.Dir)
+
+	for _, source := range sources {
+		f, err := os.Open(source)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "source %q\n", source)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// lookupEnv returns the value of name in cmd's environment.
+func lookupEnv(cmd *exec.Cmd, name string) string {
+	for i := len(cmd.Env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(cmd.Env[i], name+"=") {
+			return cmd.Env[i][len(name)+1:]
+		}
+	}
+	return ""
+}
+
+// modTime returns the modification time of the file in paths that comes
+// first according to cmp, or the zero time without any.
+func modTime(paths []string, cmp func(t, u time.Time) bool) (time.Time, error) {
+	var result time.Time
+	for i, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if i == 0 || cmp(info.ModTime(), result) {
+			result = info.ModTime()
+		}
+	}
+	return result, nil
+}
+
+// glob returns the files matching patterns, relative to c's base directory,
+// sorted and without duplicates. If all is set, and any pattern matches no
+// file, it returns nil instead.
+func (c *Command) glob(patterns []string, all bool) ([]string, error) {
+	seen := map[string]bool{}
+	files := []string{}
+	for _, pattern := range patterns {
+		matches, err := globFiles(c.baseDir(), pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+		if len(matches) == 0 && all {
+			return nil, nil
+		}
+
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// globFiles returns the regular files under dir matching pattern. Besides
+// the syntax of path.Match, a ** path segment matches any number of
+// directories.
+func globFiles(dir, pattern string) ([]string, error) {
+	pattern = filepath.ToSlash(pattern)
+	if !filepath.IsAbs(pattern) {
+		pattern = path.Join(filepath.ToSlash(dir), pattern)
+	}
+	segments := strings.Split(pattern, "/")
+
+	// Walk from the deepest directory without any wildcards.
+	i := 0
+	for i < len(segments)-1 && !hasMeta(segments[i]) {
+		i++
+	}
+	root := strings.Join(segments[:i], "/")
+	switch {
+	case root == "" && strings.HasPrefix(pattern, "/"):
+		root = "/"
+	case root == "":
+		root = "."
+	}
+	root = filepath.FromSlash(root)
+	rest := segments[i:]
+	if _, err := path.Match(strings.Join(rest, "/"), ""); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		names := strings.Split(filepath.ToSlash(rel), "/")
+		if d.IsDir() {
+			if rel != "." && !matchPrefix(rest, names) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && matchSegments(rest, names) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func hasMeta(segment string) bool {
+	return strings.ContainsAny(segment, `*?[\`)
+}
+
+// matchSegments reports whether the path segments in names match those in
+// pattern.
+func matchSegments(pattern, names []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(pattern[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], names[0]); !ok {
+			return false
+		}
+		pattern, names = pattern[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+// matchPrefix reports whether files within the directory given by the path
+// segments in names may match pattern.
+func matchPrefix(pattern, names []string) bool {
+	for _, name := range names {
+		if len(pattern) == 0 {
+			return false
+		}
+		if pattern[0] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(pattern[0], name); !ok {
+			return false
+		}
+		pattern = pattern[1:]
+	}
+	return len(pattern) > 0
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	mdast "github.com/yuin/goldmark/ast"
+	extast "github.com/yuin/goldmark/extension/ast"
+)
+
+// A VariableSource tells where the value of a variable comes from, for the
+// commands defined in the same markdown file. They are given in a table with
+// variable and source columns:
+//
+//	| variable | source                       |
+//	| -------- | ---------------------------- |
+//	| SECRET   | op://vault/aws/secret_key_id |
+//	| REGION   | env:AWS_REGION               |
+//	| TOKEN    | file:~/.config/token         |
+//	| SHA      | $(git rev-parse HEAD)        |
+//
+// A source starting with the scheme of a registered Resolver is resolved with
+// it, and any other is taken literally. Values are only resolved once needed,
+// when a command runs without the variable given otherwise.
+type VariableSource struct {
+	Name   string
+	Source string
+	Pos    Position
+
+	once  sync.Once
+	value string
+	err   error
+}
+
+// A Resolver returns the value of the variable v from its source.
+type Resolver func(ctx context.Context, v *VariableSource) (string, error)
+
+var resolvers = map[string]Resolver{
+	"env":  resolveEnv,
+	"file": resolveFile,
+	"cmd":  resolveCommand,
+	"op":   ExternalResolver("op", "read"),
+}
+
+// RegisterResolver makes variable sources starting with scheme: resolvable
+// with r, replacing any previous registration for the scheme.
+func RegisterResolver(scheme string, r Resolver) {
+	resolvers[scheme] = r
+}
+
+// ExternalResolver returns a Resolver that runs program with args followed by
+// the source, as password manager CLIs do, and takes its output as the value.
+func ExternalResolver(program string, args ...string) Resolver {
+	return func(ctx context.Context, v *VariableSource) (string, error) {
+		return commandOutput(exec.CommandContext(ctx, program, append(append([]string{}, args...), v.Source)...))
+	}
+}
+
+var schemePattern = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*):`)
+
+// Resolve returns the value of v, resolving it the first time.
+func (v *VariableSource) Resolve(ctx context.Context) (string, error) {
+	v.once.Do(func() {
+		v.value, v.err = v.resolve(ctx)
+		if v.err != nil {
+			v.err = &PositionError{Pos: v.Pos, Err: fmt.Errorf("resolving %s: %w", v.Name, v.err)}
+		}
+	})
+	return v.value, v.err
+}
+
+// placeholder stands for v's value in a dry run, which doesn't resolve it.
+func (v *VariableSource) placeholder() string {
+	return fmt.Sprintf("<from variables table: %s>", v.Source)
+}
+
+func (v *VariableSource) resolve(ctx context.Context) (string, error) {
+	if strings.HasPrefix(v.Source, "$(") && strings.HasSuffix(v.Source, ")") {
+		return resolvers["cmd"](ctx, v)
+	}
+
+	if m := schemePattern.FindStringSubmatch(v.Source); m != nil {
+		if r, ok := resolvers[m[1]]; ok {
+			return r(ctx, v)
+		}
+	}
+	return v.Source, nil
+}
+
+func resolveEnv(ctx context.Context, v *VariableSource) (string, error) {
+	name := strings.TrimPrefix(v.Source, "env:")
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable not set: %s", name)
+	}
+	return value, nil
+}
+
+// resolveFile reads the value from a file, relative to the markdown file the
+// source is given in, dropping the trailing newline.
+func resolveFile(ctx context.Context, v *VariableSource) (string, error) {
+	p := strings.TrimPrefix(v.Source, "file:")
+	if strings.HasPrefix(p, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		p = filepath.Join(home, p[2:])
+	} else if !filepath.IsAbs(p) {
+		p = filepath.Join(inputDir(v.Pos.Path), p)
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// resolveCommand takes the output of a shell command, given as $(...) or
+// cmd:..., as the value.
+func resolveCommand(ctx context.Context, v *VariableSource) (string, error) {
+	command := strings.TrimPrefix(v.Source, "cmd:")
+	if strings.HasPrefix(command, "$(") {
+		command = command[2 : len(command)-1]
+	}
+	return commandOutput(exec.CommandContext(ctx, "sh", "-c", command))
+}
+
+// commandOutput runs cmd, returning its output without the trailing newline.
+// Only its errors are shown, as the output may well be a secret.
+func commandOutput(cmd *exec.Cmd) (string, error) {
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %w: %s", cmd.Args[0], err, msg)
+		}
+		return "", fmt.Errorf("%s: %w", cmd.Args[0], err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// parseVariableTable returns the variable sources given in table, or nil if
+// it isn't a table of variables.
+func parseVariableTable(inputPath string, source []byte, table *extast.Table) (map[string]*VariableSource, error) {
+	header, ok := table.FirstChild().(*extast.TableHeader)
+	if !ok || header.ChildCount() != 2 {
+		return nil, nil
+	}
+	if cellText(header.FirstChild(), source) != "variable" || cellText(header.LastChild(), source) != "source" {
+		return nil, nil
+	}
+
+	vars := map[string]*VariableSource{}
+	for row := header.NextSibling(); row != nil; row = row.NextSibling() {
+		name, src := cellText(row.FirstChild(), source), cellText(row.LastChild(), source)
+		if row.ChildCount() != 2 || name == "" {
+			continue
+		}
+
+		pos := positionAt(inputPath, source, nodeStart(row))
+		if prev, ok := vars[name]; ok {
+			return nil, &PositionError{Pos: pos, Err: fmt.Errorf("variable %s is already given at %s", name, prev.Pos)}
+		}
+		vars[name] = &VariableSource{Name: name, Source: src, Pos: pos}
+	}
+
+	return vars, nil
+}
+
+func cellText(cell mdast.Node, source []byte) string {
+	if cell == nil {
+		return ""
+	}
+	return strings.TrimSpace(string(cell.Text(source)))
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+// Defaults for WatchOptions left zero.
+const (
+	DefaultWatchInterval = 500 * time.Millisecond
+	DefaultWatchDebounce = 200 * time.Millisecond
+)
+
+// WatchOptions configure Watch.
+type WatchOptions struct {
+	// Interval is how often the sources are checked for changes, or
+	// DefaultWatchInterval if zero.
+	Interval time.Duration
+
+	// Debounce is how long the sources must stay unchanged before the
+	// command is run again, so that a burst of changes runs it only once.
+	// It is DefaultWatchDebounce if zero, and a negative one doesn't wait.
+	Debounce time.Duration
+
+	// Clear clears the screen before each run.
+	Clear bool
+}
+
+// fileState is what tells whether a file changed.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Watch runs c, then runs it again whenever the sources of c or the commands
+// it needs change, until ctx is done. A run still going when the sources
+// change is cancelled first.
+func (c *Command) Watch(ctx context.Context, f *flag.FlagSet, opts *WatchOptions, args ...interface{}) error {
+	o := WatchOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Interval <= 0 {
+		o.Interval = DefaultWatchInterval
+	}
+	if o.Debounce == 0 {
+		o.Debounce = DefaultWatchDebounce
+	}
+	opts = &o
+
+	plan := planFor([]*Command{c})
+	watched := false
+	for _, p := range plan {
+		watched = watched || len(p.Sources) > 0
+	}
+	if !watched {
+		return fmt.Errorf("%s declares no sources to watch", c.Alias)
+	}
+
+	std := optionsFrom(ctx).stdio()
+	scan := func() (map[string]fileState, error) {
+		files := map[string]fileState{}
+		for _, p := range plan {
+			sources, err := p.glob(p.Sources, false)
+			if err != nil {
+				return nil, err
+			}
+			for _, source := range sources {
+				info, err := os.Stat(source)
+				if err != nil {
+					// Removed since globbing, which the next scan
+					// will notice.
+					continue
+				}
+				files[source] = fileState{info.ModTime(), info.Size()}
+			}
+		}
+		return files, nil
+	}
+
+	snapshot, err := scan()
+	if err != nil {
+		return err
+	}
+
+	var cancel context.CancelFunc
+	done := make(chan subcommands.ExitStatus, 1)
+	start := func() {
+		if opts.Clear {
+			fmt.Fprint(std.out, "\033[H\033[2J")
+		}
+
+		var runCtx context.Context
+		runCtx, cancel = context.WithCancel(ctx)
+		go func() { done <- c.Execute(runCtx, f, args...) }()
+	}
+	running := true
+	start()
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	var changedAt time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			cancel()
+			if running {
+				<-done
+			}
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return nil
+			}
+			return ctx.Err()
+
+		case status := <-done:
+			running = false
+			if status != subcommands.ExitSuccess {
+				fmt.Fprintf(std.err, "%s failed with exit status %d\n", c.Alias, status)
+			}
+			fmt.Fprintf(std.err, "watching %d files for changes\n", len(snapshot))
+
+		case now := <-ticker.C:
+			files, err := scan()
+			if err != nil {
+				cancel()
+				return err
+			}
+			if !sameFiles(files, snapshot) {
+				snapshot = files
+				changedAt = now
+			}
+
+			if changedAt.IsZero() || now.Sub(changedAt) < opts.Debounce {
+				continue
+			}
+			changedAt = time.Time{}
+
+			cancel()
+			if running {
+				<-done
+			}
+			running = true
+			start()
+		}
+	}
+}
+
+func sameFiles(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, state := range a {
+		if other, ok := b[name]; !ok || !state.modTime.Equal(other.modTime) || state.size != other.size {
+			return false
+		}
+	}
+	return true
+}